@@ -3,6 +3,11 @@ module github.com/ddlfcloud/nfs-prober
 go 1.14
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/prometheus/client_golang v1.7.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.10.0
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 )
@@ -23,21 +23,28 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	mrand "math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ddlfcloud/nfs-prober/prober"
+	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -47,210 +54,744 @@ var (
 	readAndWrite       = flag.Bool("rw_test_files", false, "read and write test files and log results, default false")
 	numOfTestFiles     = flag.Int("num_of_files", 1, "number of test files to read and write, default 1")
 	testFileSize       = flag.Int("file_size_bytes", 200, "test file size in bytes, default 200")
-	targets            = flag.String("targets", "", "comma seperated list of targets in format ip:/mountPoint")
-	interval           = flag.String("interval", "60s", "interval between probes, default 60s")
-	timeout            = flag.String("timeout", "250ms", "timeout of probe operation, default 250ms")
-	webPort            = flag.Int("port", 8080, "port for web server to listen on")
+	targets            = flag.String("targets", "", "comma seperated list of targets in format ip:/mountPoint, several mount points on one host can be given as ip:/mountPoint;/mountPoint")
+	interval           = flag.Duration("interval", 60*time.Second, "interval between probes, eg 60s or 1m, default 60s")
+	timeout            = flag.Duration("timeout", 250*time.Millisecond, "timeout of probe operation, eg 250ms, default 250ms")
+	rwInterval         = flag.Duration("rw_interval", 0, "interval between reading and writing test files, rounded to a multiple of interval, defaults to interval")
+	ioTimeout          = flag.Duration("io_timeout", 0, "timeout of the test file read and write phase, defaults to timeout")
+	webPort            = flag.Int("port", 8080, "port for web server to listen on, 0 disables the web server")
+	httpDisabled       = flag.Bool("http_disabled", false, "don't start the web server, metrics and health checks aren't served, default false")
 	version            = flag.String("nfs_version", "nfs", "nfs version to use, eg nfs, nfs3")
+	testFileModeStr    = flag.String("test_file_mode", "0644", "octal file mode used when writing test files, default 0644")
+	maxMountDuration   = flag.Duration("max_mount_duration", 0, "mounts slower than this are counted in nfs_mount_slow_total, 0s disables, default 0s")
+	hangThreshold      = flag.Duration("hang_threshold", 30*time.Second, "how long a mount syscall can block before it is reported as hung, default 30s")
+	validate           = flag.Bool("validate", false, "validate targets, durations and the local mount directory then exit without mounting, default false")
+	keepMountOnTimeout = flag.Bool("keep_mount_on_timeout", false, "leave the mount in place when a probe times out so it can be inspected, default false")
+	statTest           = flag.Bool("stat_test", false, "stat the prober directory after each mount, a cheaper check than rw_test_files, default false")
+	webhookURL         = flag.String("webhook_url", "", "url to post JSON notifications to when a target starts or stops failing, disabled by default")
+	alertAfter         = flag.Int("alert_after", 3, "consecutive failures before the webhook is notified, default 3")
+	reconcileOnStart   = flag.Bool("reconcile_on_start", false, "unmount orphaned mounts and remove unused empty directories in local_mount_dir on startup, default false")
+	verifyRounds       = flag.Int("verify_rounds", 0, "times each test file is written and read back to compare its content, requires rw_test_files, default 0")
+	dropCaches         = flag.Bool("drop_caches", false, "drop the cached pages of a test file before reading it back in verify_rounds, default false")
+	reachabilityCheck  = flag.Bool("reachability_check", false, "dial the nfs port of the server before each mount and record nfs_server_reachable, default false")
+	nfsPort            = flag.Int("nfs_port", 2049, "port dialed by reachability_check, default 2049")
+	readyRequiresAll   = flag.Bool("ready_requires_all", false, "only report ready on /ready once every target has had a successful probe, default false")
+	persistFiles       = flag.Bool("persist_files", false, "write test files once and verify them on later probes, rewriting only files that fail, requires rw_test_files, default false")
+	mountOptions       = flag.String("mount_options", "", "extra comma separated nfs mount options, eg sec=krb5p,vers=4.2, addr is always set and nolock unless lock is given")
+	configFile         = flag.String("config_file", "", "JSON file of targets and their settings, added to targets, disabled by default")
+	randomFileOrder    = flag.Bool("random_file_order", false, "write and read test files in a random order each cycle rather than 0 to num_of_files-1, default false")
+	runtimeMetrics     = flag.Bool("runtime_metrics", true, "export go runtime and process metrics such as go_goroutines and process_open_fds, default true")
+	fileSizeJitter     = flag.Int("file_size_jitter", 0, "randomize each test file size by up to this percentage of file_size_bytes either way, default 0")
+	warmup             = flag.Duration("warmup", 0, "failed probes this soon after starting are logged but don't count towards alerts, default 0s")
+	nfsProto           = flag.String("nfs_proto", "tcp", "transport to mount over, tcp or udp, a proto in mount_options takes precedence, default tcp")
+	resultStream       = flag.String("result_stream", "", "write a JSON object per line for each probe result to this file, - for stdout with the log moved to stderr, disabled by default")
+	verifyMountTable   = flag.Bool("verify_mount_table", false, "check each mount is in /proc/mounts with the expected filesystem type, linux only, default false")
+	unmountRetries     = flag.Int("unmount_retries", 3, "times a busy unmount before mounting is retried before it is lazily detached, default 3")
+	unmountBackoff     = flag.Duration("unmount_backoff", 100*time.Millisecond, "wait before the first unmount retry, doubled for each retry, default 100ms")
+	maxRuntime         = flag.Duration("max_runtime", 0, "probe for this long then unmount every target and exit 0, 0s runs forever, default 0s")
+	successWindow      = flag.Int("success_window", 20, "number of latest probes the nfs_*_success_ratio gauges are computed over, 0 disables, default 20")
+	testUID            = flag.Int("test_uid", 0, "filesystem uid test files are written and read as, to test root-squash, default 0")
+	testGID            = flag.Int("test_gid", 0, "filesystem gid test files are written and read as, default 0")
+	seed               = flag.Int64("seed", 0, "seed for the startup stagger, file order and size jitter so they are reproducible, 0 seeds from the current time, default 0")
+	dirTest            = flag.Bool("dir_test", false, "create, stat and remove a directory in the prober directory after each mount, default false")
+	symlinkTest        = flag.Bool("symlink_test", false, "create a symlink in the prober directory, read it back and remove it after each mount, default false")
+	forceUnmount       = flag.Bool("force_unmount_before_mount", true, "unmount and mount every target on each probe, false reuses a mount while it passes a health check, default true")
+	pidFile            = flag.String("pid_file", "", "write the process id to this file and remove it on exit, fails to start if it belongs to a running process, disabled by default")
+	writeRateLimit     = flag.Int("write_rate_limit", 0, "throttle test file writes to this many bytes per second, 0 is unlimited, default 0")
+	requireVersion     = flag.Bool("require_version", false, "fail a mount if the server negotiates another nfs version than the vers in mount_options, default false")
+	breakerThreshold   = flag.Int("breaker_threshold", 0, "consecutive failures after which a target is probed less often, doubling its interval on each failure, 0 disables, default 0")
+	breakerMaxInterval = flag.Duration("breaker_max_interval", 10*time.Minute, "longest interval between probes of a failing target, default 10m")
+	openMetrics        = flag.Bool("open_metrics", false, "serve the OpenMetrics format to scrapers that ask for it, default false")
+	mtimeSkewThreshold = flag.Duration("mtime_skew_threshold", 30*time.Second, "log a warning when a written test file's mtime is further than this from the local clock, 0s disables, default 30s")
+	restartHungAfter   = flag.Int("restart_hung_after", 0, "start a new probe goroutine for a target when a probe cycle has run for this many intervals, abandoning the stuck one, 0 disables, default 0")
+	watchConfigFile    = flag.Bool("watch_config_file", false, "reload the targets when config_file changes, including a Kubernetes ConfigMap update, as on SIGHUP, default false")
+	logSuccessMounts   = flag.Bool("log_success_mounts", true, "log successful mounts, failures are always logged, default true")
+	logSuccessReads    = flag.Bool("log_success_reads", false, "log successful test file reads and verifications, failures are always logged, default false")
+	logSuccessWrites   = flag.Bool("log_success_writes", false, "log successful test file writes, failures are always logged, default false")
+	onDemand           = flag.Bool("on_demand", false, "only probe targets when requested with /probe?target=, nothing is probed in the background, default false")
+	mountRetries       = flag.Int("mount_retries", 0, "times a failed mount is retried within a probe when it fails with one of mount_retry_errnos, default 0")
+	mountRetryErrnos   = flag.String("mount_retry_errnos", "ETIMEDOUT,ECONNREFUSED,EHOSTUNREACH,EAGAIN", "comma separated errnos a failed mount is retried on, other errors fail the probe straight away, default ETIMEDOUT,ECONNREFUSED,EHOSTUNREACH,EAGAIN")
+	latencyBuckets     = flag.String("latency_buckets", "", "comma separated upper bounds in seconds of the latency histogram buckets, empty uses the Prometheus defaults, default empty")
+	readBuckets        = flag.String("read_buckets", "", "comma separated upper bounds in seconds of the nfs_read_attempts_seconds buckets, empty uses latency_buckets, default empty")
+	writeBuckets       = flag.String("write_buckets", "", "comma separated upper bounds in seconds of the nfs_write_attempts_seconds buckets, empty uses latency_buckets, default empty")
+	failureInjection   = flag.Bool("failure_injection", false, "serve /debug/inject to make a target's probes fail on purpose for testing alerting, default false")
+	minFailuresDown    = flag.Int("min_failures_before_down", 1, "consecutive failed probes before nfs_status is set to 0, until then it keeps its last value, default 1")
+	listenAddress      = flag.String("listen_address", "", "comma separated addresses for the web server to listen on, eg 127.0.0.1:8080 or [::1]:8080, empty listens on port on every interface, default empty")
+	selfTest           = flag.Bool("self_test", false, "register every metric on a fresh registry and gather them, then exit 0 if they are all unique and well formed or 1 if not, without mounting, default false")
+	dnsTimeout         = flag.Duration("dns_timeout", 0, "timeout of looking up the address of a hostname target, 0s only bounds it by timeout, default 0s")
+	dnsCacheTTL        = flag.Duration("dns_cache_ttl", 60*time.Second, "how long the address of a hostname target is reused before it is looked up again, default 60s")
+	fixedTestData      = flag.Bool("fixed_test_data", false, "write the same random content, drawn once at startup, to the test files every probe instead of new content per write, default false")
+	appendTest         = flag.Bool("append_test", false, "append a record to a test file with O_APPEND after each mount and check the file grew by exactly the record, default false")
+	appendTruncate     = flag.Int("append_truncate_every", 100, "truncate the append test file before every this many appends, 0 truncates before every append, default 100")
+	disableCompression = flag.Bool("disable_compression", false, "serve /metrics uncompressed even to scrapers that accept gzip, for debugging, default false")
+	maxFileAge         = flag.Duration("max_file_age", 0, "with persist_files, rewrite a test file once it was written this long ago even if it passes verification, 0s only rewrites files that fail, default 0s")
+	useExistingMount   = flag.Bool("use_existing_mount", false, "probe targets where they are already mounted, their config file path or local_mount_dir, instead of mounting and unmounting them, default false")
+	failFastIO         = flag.Bool("fail_fast_io", false, "stop a probe's test file reads or writes at the first failure instead of trying every file, default false")
+	readFirst          = flag.Bool("read_first", false, "read and verify the test files written by the previous probe before writing them again, instead of reading them back after writing, default false")
+	historySize        = flag.Int("history_size", 60, "number of latest probe results kept per target and served at /history, 0 disables /history, default 60")
+	canaryFile         = flag.String("canary_file", "", "file pre-seeded on the export, relative to the prober directory, read instead of writing and reading test files, default empty")
+	canarySHA256       = flag.String("canary_sha256", "", "expected hex SHA-256 of the canary_file, checked on every read, empty only reads it, default empty")
+	sampleSlices       = flag.Int("sample_slices", 0, "split the targets into this many slices probed in turn, one slice each interval, so every target is probed once every sample_slices intervals, 0 probes every target each interval, default 0")
+	chmodTest          = flag.Bool("chmod_test", false, "chmod test files to a new mode and stat them back after writing, requires rw_test_files, default false")
 )
 
-type nfs struct {
-	address    string
-	mountPoint string
-	log        *logrus.Logger
+var ready = false
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if ready {
+		w.WriteHeader(200)
+		return
+	}
+	w.WriteHeader(500)
+	return
 }
 
-var (
-	status = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "nfs_status",
-		Help: "current mount status of an NFS target",
-	}, []string{"address", "mount_point"})
-	mountAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "nfs_mount_attempts",
-		Help: "attempts made to connect to an NFS target",
-	}, []string{"address", "mount_point", "success"})
-	readAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "nfs_read_attempts",
-		Help: "attempts to read a file from a target NFS instance",
-	}, []string{"address", "mount_point", "testFile", "success"})
-	writeAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "nfs_write_attempts",
-		Help: "attempts to write a file to a target NFS instance",
-	}, []string{"address", "mount_point", "testFile", "success"})
-	ready = false
-)
+// readyHandler is healthy once started, or with ready_requires_all once every target
+// has had a successful probe.
+func readyHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ready && (!*readyRequiresAll || p.Status().Pending == 0) {
+			w.WriteHeader(200)
+			return
+		}
+		w.WriteHeader(500)
+	}
+}
 
-func (n *nfs) unmount(ctx context.Context) {
-	syscall.Unmount(fmt.Sprintf("%s/%s", *localMountLocation, n.address), 0)
+// statusHandler serves the latest state of every target as JSON.
+func statusHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Status())
+	}
 }
 
-func (n *nfs) mount(ctx context.Context) error {
-	// Ensure NFS is unmounted before starting
-	n.unmount(ctx)
-	// Start Time to be used for all duration logs
-	startTime := time.Now()
-	// Use syscall to mount the NFS directory
-	err := syscall.Mount(fmt.Sprintf(":%s", n.mountPoint), fmt.Sprintf("%s/%s", *localMountLocation, n.address), *version, 0, fmt.Sprintf("nolock,addr=%s", n.address))
-	duration := time.Since(startTime).Seconds()
-	if err != nil {
-		n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration}).Warn("could not mount")
-		if *usePrometheus {
-			status.WithLabelValues(n.address, n.mountPoint).Set(0)
-			mountAttempts.WithLabelValues(n.address, n.mountPoint, "false").Observe(duration)
+// historyHandler serves the latest probe results of a configured target as JSON, up
+// to limit of them, oldest first.
+func historyHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		n.unmount(ctx)
-		return err
+		target, ok := requestTarget(w, r, p)
+		if !ok {
+			return
+		}
+		limit := 0
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				http.Error(w, "limit must be a number of results", http.StatusBadRequest)
+				return
+			}
+		}
+		history, err := p.History(target, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
 	}
-	n.log.WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration}).Info("mount successful")
-	if *usePrometheus {
-		status.WithLabelValues(n.address, n.mountPoint).Set(1)
-		mountAttempts.WithLabelValues(n.address, n.mountPoint, "true").Observe(duration)
+}
+
+// configHandler serves the effective config of the prober as JSON.
+func configHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(p.EffectiveConfig())
 	}
-	return nil
 }
 
-func (n *nfs) readTestFiles(ctx context.Context) {
-	for i := 0; i < *numOfTestFiles; i++ {
-		testFileLocation := fmt.Sprintf("%s/%s/%d", *localMountLocation, n.address, i)
-		startTime := time.Now()
-		b, err := ioutil.ReadFile(testFileLocation)
-		duration := time.Since(startTime).Seconds()
-		if err != nil {
-			n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": testFileLocation}).Warn("could not read test file")
-			if *usePrometheus {
-				readAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "false").Observe(duration)
-			}
-			continue
+// targetHandler pauses or resumes probing the target in the target query parameter.
+func targetHandler(p *prober.Prober, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		if len(b) != *testFileSize {
-			n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": fmt.Sprintf("got %d bytes from file, but expected %d bytes", len(b), *testFileSize), "duration": duration, "file": testFileLocation}).Warn("could not read test file")
-			if *usePrometheus {
-				readAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "false").Observe(duration)
-			}
+		target, ok := requestTarget(w, r, p)
+		if !ok {
+			return
 		}
-		n.log.WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": testFileLocation}).Info("read test file")
-		if *usePrometheus {
-			readAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "true").Observe(duration)
+		if err := p.SetEnabled(target, enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		w.WriteHeader(200)
 	}
 }
 
-func (n *nfs) writeTestFiles(ctx context.Context) {
-	for i := 0; i < *numOfTestFiles; i++ {
-		testFileLocation := fmt.Sprintf("%s/%s/%d", *localMountLocation, n.address, i)
-		b := make([]byte, *testFileSize)
-		_, err := rand.Read(b)
-		if err != nil {
-			n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "file": testFileLocation}).Warn("could not create test file")
-			continue
+// probeHandler runs a probe cycle against a configured target and returns the result
+// as JSON, with status 503 if anything failed.
+func probeHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		startTime := time.Now()
-		err = ioutil.WriteFile(testFileLocation, b, 0644)
-		duration := time.Since(startTime).Seconds()
-		if err != nil {
-			n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": testFileLocation}).Warn("could not write test file")
-			if *usePrometheus {
-				writeAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "false").Observe(duration)
-			}
-			continue
+		target, ok := requestTarget(w, r, p)
+		if !ok {
+			return
 		}
-		// make sure the number of bytes read matches the file size
-		if len(b) != *testFileSize {
-			n.log.WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": fmt.Sprintf("got %d bytes from file, but expected %d bytes", len(b), *testFileSize), "duration": duration, "file": testFileLocation}).Warn("could not read test file")
-			if *usePrometheus {
-				writeAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "false").Observe(duration)
+		result, _ := p.Probe(r.Context(), target)
+		w.Header().Set("Content-Type", "application/json")
+		if result.Err() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// maxInjectCycles bounds an injected failure so a forgotten one ends on its own.
+const maxInjectCycles = 100
+
+// injectHandler makes the next cycles probes of a configured target fail, or stops an
+// injection with fail=false.
+func injectHandler(p *prober.Prober) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, ok := requestTarget(w, r, p)
+		if !ok {
+			return
+		}
+		cycles := 0
+		if r.URL.Query().Get("fail") != "false" {
+			cycles = 1
+			if s := r.URL.Query().Get("cycles"); s != "" {
+				var err error
+				cycles, err = strconv.Atoi(s)
+				if err != nil || cycles < 1 || cycles > maxInjectCycles {
+					http.Error(w, fmt.Sprintf("cycles must be between 1 and %d", maxInjectCycles), http.StatusBadRequest)
+					return
+				}
 			}
 		}
-		n.log.WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": testFileLocation}).Info("write test file")
-		if *usePrometheus {
-			writeAttempts.WithLabelValues(n.address, n.mountPoint, testFileLocation, "true").Observe(duration)
+		if err := p.InjectFailure(target, cycles); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		w.WriteHeader(200)
 	}
 }
 
-func (n *nfs) test(ctx context.Context) {
-	intervalDur, err := time.ParseDuration(*interval)
-	if err != nil {
-		n.log.Fatal(err)
+// requestTarget returns the target in the target and variant query parameters, or
+// writes an error and returns false if it isn't a configured target.
+func requestTarget(w http.ResponseWriter, r *http.Request, p *prober.Prober) (prober.Target, bool) {
+	targets, err := prober.ParseTargets(r.URL.Query().Get("target"))
+	if err != nil || len(targets) != 1 {
+		http.Error(w, "target must be a single target in format ip:/mountPoint", http.StatusBadRequest)
+		return prober.Target{}, false
 	}
-	timeoutDur, err := time.ParseDuration(*timeout)
+	targets[0].Variant = r.URL.Query().Get("variant")
+	// Only act on configured targets, anything else could be used to mount arbitrary exports
+	if !p.Configured(targets[0]) {
+		http.Error(w, "target is not configured", http.StatusForbidden)
+		return prober.Target{}, false
+	}
+	return targets[0], true
+}
+
+// runSelfTest registers every metric the prober serves on a fresh registry and gathers
+// them, returning an error for a duplicate or malformed metric that would otherwise
+// only show up at startup.
+func runSelfTest(config prober.Config) (err error) {
+	defer func() {
+		// promauto panics on a metric that can't be registered
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	registry := prometheus.NewPedanticRegistry()
+	config.Registry = registry
+	config.UsePrometheus = true
+	config.RuntimeMetrics = true
+	config.OnResult = resultReporter(logrus.New(), registry)
+	if _, err := prober.New(config); err != nil {
+		return err
+	}
+	metricsHandler(registry, registry)
+	families, err := registry.Gather()
 	if err != nil {
-		n.log.Fatal(err)
+		return err
 	}
-	ticker := time.NewTicker(intervalDur)
-	done := make(chan bool)
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			ctxWithTimeout, cancel := context.WithTimeout(ctx, timeoutDur)
-			defer cancel()
-			err := n.mount(ctxWithTimeout)
-			if err != nil {
+	fmt.Printf("self test passed, %d metric families gathered\n", len(families))
+	return nil
+}
+
+// failureMessages are what a failed operation of each kind is logged as.
+var failureMessages = map[string]string{
+	"mount": "could not mount",
+	"write": "could not write test file",
+	"read":  "could not read test file",
+}
+
+// resultReporter returns the prober's OnResult, logging every failed mount, test file
+// write and read of a probe cycle and counting them in nfs_probe_errors_total by the
+// operation and the reason of their ProbeError. The prober logs the other operations.
+func resultReporter(log *logrus.Logger, registerer prometheus.Registerer) func(prober.Result) {
+	probeErrors := promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+		Name: "nfs_probe_errors_total",
+		Help: "failed mounts, test file writes and reads by operation and reason",
+	}, []string{"address", "mount_point", "op", "reason"})
+	return func(result prober.Result) {
+		errs := []error{result.MountErr}
+		for _, results := range [][]prober.FileResult{result.Writes, result.Reads} {
+			for _, r := range results {
+				errs = append(errs, r.Err)
+			}
+		}
+		for _, err := range errs {
+			var probeErr *prober.ProbeError
+			if !errors.As(err, &probeErr) {
 				continue
 			}
-			if *readAndWrite {
-				n.writeTestFiles(ctx)
-				n.readTestFiles(ctx)
+			fields := logrus.Fields{"success": false, "address": result.Target.Address, "mountPoint": result.Target.MountPoint, "cycle_id": result.CycleID, "err": probeErr.Err, "reason": probeErr.Reason}
+			if probeErr.File != "" {
+				fields["file"] = probeErr.File
+			}
+			log.WithFields(fields).Warn(failureMessages[probeErr.Op])
+			if *usePrometheus {
+				probeErrors.WithLabelValues(result.Target.Address, result.Target.MountPoint, probeErr.Op, probeErr.Reason).Inc()
 			}
 		}
 	}
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if ready {
-		w.WriteHeader(200)
-		return
+// metricsHandler serves the default registry, recording how long gathering took in
+// nfs_prober_scrape_duration_seconds, which is served on the next scrape.
+func metricsHandler(registerer prometheus.Registerer, gatherer prometheus.Gatherer) http.Handler {
+	factory := promauto.With(registerer)
+	up := factory.NewGauge(prometheus.GaugeOpts{
+		Name: "nfs_prober_up",
+		Help: "always 1 while the prober is running and serving metrics",
+	})
+	up.Set(1)
+	scrapeDuration := factory.NewGauge(prometheus.GaugeOpts{
+		Name: "nfs_prober_scrape_duration_seconds",
+		Help: "time spent gathering metrics for the previous scrape",
+	})
+	timed := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		startTime := time.Now()
+		defer func() {
+			scrapeDuration.Set(time.Since(startTime).Seconds())
+		}()
+		return gatherer.Gather()
+	})
+	return promhttp.InstrumentMetricHandler(registerer, promhttp.HandlerFor(timed, promhttp.HandlerOpts{
+		EnableOpenMetrics:  *openMetrics,
+		DisableCompression: *disableCompression,
+	}))
+}
+
+// writePIDFile writes the process id to path, failing if it holds the id of a process
+// that is still running so the prober isn't started twice.
+func writePIDFile(path string) error {
+	if b, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		// Signal 0 only checks the process exists, EPERM means it belongs to someone else
+		if err == nil && pid > 0 {
+			if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+				return fmt.Errorf("pid file %s belongs to running process %d", path, pid)
+			}
+		}
 	}
-	w.WriteHeader(500)
-	return
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// envPrefix is prepended to the upper cased flag name to get its environment variable
+const envPrefix = "NFS_PROBER_"
+
+// setFlagsFromEnv fills any flag not set on the command line from its environment
+// variable, so precedence is explicit flag > environment > default.
+func setFlagsFromEnv() error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envPrefix + strings.ToUpper(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s%s: %v", value, envPrefix, strings.ToUpper(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// configFromFlags builds the prober config from the command line flags, returning
+// every flag that could not be parsed.
+func configFromFlags() (prober.Config, []error) {
+	var errs []error
+	config := prober.Config{
+		LocalMountDir:         *localMountLocation,
+		FSType:                *version,
+		ReadWrite:             *readAndWrite,
+		NumOfTestFiles:        *numOfTestFiles,
+		TestFileSize:          *testFileSize,
+		ChmodTest:             *chmodTest,
+		KeepMountOnTimeout:    *keepMountOnTimeout,
+		WebhookURL:            *webhookURL,
+		AlertAfter:            *alertAfter,
+		StatTest:              *statTest,
+		ReconcileOnStart:      *reconcileOnStart,
+		VerifyRounds:          *verifyRounds,
+		DropCaches:            *dropCaches,
+		ReachabilityCheck:     *reachabilityCheck,
+		NFSPort:               *nfsPort,
+		PersistFiles:          *persistFiles,
+		MountOptions:          *mountOptions,
+		RandomFileOrder:       *randomFileOrder,
+		RuntimeMetrics:        *runtimeMetrics,
+		FileSizeJitter:        *fileSizeJitter,
+		Proto:                 *nfsProto,
+		VerifyMountTable:      *verifyMountTable,
+		UnmountRetries:        *unmountRetries,
+		SuccessWindow:         *successWindow,
+		TestUID:               *testUID,
+		TestGID:               *testGID,
+		Seed:                  *seed,
+		DirTest:               *dirTest,
+		SymlinkTest:           *symlinkTest,
+		ReuseMount:            !*forceUnmount,
+		WriteRateLimit:        *writeRateLimit,
+		RequireVersion:        *requireVersion,
+		BreakerThreshold:      *breakerThreshold,
+		Interval:              *interval,
+		Timeout:               *timeout,
+		RWInterval:            *rwInterval,
+		IOTimeout:             *ioTimeout,
+		MaxMountDuration:      *maxMountDuration,
+		HangThreshold:         *hangThreshold,
+		Warmup:                *warmup,
+		UnmountBackoff:        *unmountBackoff,
+		MaxRuntime:            *maxRuntime,
+		BreakerMaxInterval:    *breakerMaxInterval,
+		MtimeSkewThreshold:    *mtimeSkewThreshold,
+		RestartHungAfter:      *restartHungAfter,
+		QuietMounts:           !*logSuccessMounts,
+		QuietReads:            !*logSuccessReads,
+		QuietWrites:           !*logSuccessWrites,
+		OnDemand:              *onDemand,
+		MountRetries:          *mountRetries,
+		MinFailuresBeforeDown: *minFailuresDown,
+		DNSTimeout:            *dnsTimeout,
+		DNSCacheTTL:           *dnsCacheTTL,
+		FixedTestData:         *fixedTestData,
+		AppendTest:            *appendTest,
+		AppendTruncateEvery:   *appendTruncate,
+		MaxFileAge:            *maxFileAge,
+		UseExistingMount:      *useExistingMount,
+		FailFastIO:            *failFastIO,
+		ReadFirst:             *readFirst,
+		HistorySize:           *historySize,
+		CanaryFile:            *canaryFile,
+		CanarySHA256:          *canarySHA256,
+		SampleSlices:          *sampleSlices,
+		UsePrometheus:         *usePrometheus,
+	}
+	var err error
+	// The self test only registers metrics, it doesn't need any targets
+	if *targets != "" || (*configFile == "" && !*selfTest) {
+		config.Targets, err = prober.ParseTargets(*targets)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if *configFile != "" {
+		file, err := prober.LoadConfigFile(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			file.Apply(&config)
+		}
+	}
+	config.LatencyBuckets, err = prober.ParseBuckets(*latencyBuckets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid latency_buckets: %v", err))
+	}
+	config.ReadBuckets, err = prober.ParseBuckets(*readBuckets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid read_buckets: %v", err))
+	}
+	config.WriteBuckets, err = prober.ParseBuckets(*writeBuckets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid write_buckets: %v", err))
+	}
+	config.MountRetryErrnos, err = prober.ParseErrnos(*mountRetryErrnos)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid mount_retry_errnos: %v", err))
+	}
+	mode, err := strconv.ParseUint(*testFileModeStr, 8, 32)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid test_file_mode %s: %v", *testFileModeStr, err))
+	}
+	config.TestFileMode = os.FileMode(mode)
+	return config, errs
+}
+
+// validateConfig runs every preflight check without mounting and prints a summary,
+// it returns false if anything was not well formed.
+func validateConfig(config prober.Config, errs []error) bool {
+	if err := prober.CheckLocalMountDir(config.LocalMountDir); err != nil {
+		errs = append(errs, err)
+	}
+	// Register against a throwaway registry, nothing is served in validate mode
+	config.Registry = prometheus.NewRegistry()
+	p, err := prober.New(config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if p == nil {
+		return false
+	}
+	for _, target := range config.Targets {
+		fmt.Printf("target address=%s mountPoint=%s/prober variant=%s localDir=%s fstype=%s options=%s\n", target.Address, target.MountPoint, target.Variant, p.LocalDir(target), config.FSType, p.MountOptions(target))
+	}
+	return len(errs) == 0
 }
 
 func main() {
 	flag.Parse()
+	if err := setFlagsFromEnv(); err != nil {
+		log.Fatal(err)
+	}
 	newLog := logrus.New()
 	newLog.Out = os.Stdout
-	if *targets == "" {
+	if *targets == "" && *configFile == "" && !*selfTest {
 		log.Print("please specify targets")
 	}
-	// Max of 5 files allowed.
-	if *numOfTestFiles > 5 {
-		*numOfTestFiles = 5
+	config, errs := configFromFlags()
+	config.Log = newLog
+	if *resultStream == "-" {
+		config.ResultStream = os.Stdout
+		// Keeps stdout to the JSON lines, the log would be interleaved with them
+		newLog.Out = os.Stderr
+	} else if *resultStream != "" {
+		f, err := os.OpenFile(*resultStream, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("could not open result_stream: %v", err)
+		}
+		defer f.Close()
+		config.ResultStream = f
+	}
+	config.Registry = prometheus.DefaultRegisterer
+	if !*runtimeMetrics {
+		// The default registry starts with the runtime collectors registered
+		prometheus.Unregister(prometheus.NewGoCollector())
+		prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	}
-	ctx := context.Background()
-
-	// Get list of NFS targets from cmd line arguments
-	listOfTargets := strings.Split(*targets, ",")
+	if *validate {
+		if !validateConfig(config, errs) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(errs) > 0 {
+		log.Print(errs[0])
+		os.Exit(1)
+	}
+	if *selfTest {
+		if err := runSelfTest(config); err != nil {
+			fmt.Printf("self test failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// Fail fast rather than have every mount fail because of the local directory
+	if err := prober.CheckLocalMountDir(config.LocalMountDir); err != nil {
+		log.Fatal(err)
+	}
+	config.OnResult = resultReporter(newLog, config.Registry)
+	p, err := prober.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(*pidFile)
+	}
+	ready = true
+	var servers []*http.Server
+	if *onDemand && (*httpDisabled || *webPort == 0) {
+		log.Fatal("on_demand needs the HTTP endpoint for /probe")
+	}
+	if *httpDisabled || *webPort == 0 {
+		logrus.Info("HTTP endpoint disabled")
+	} else {
+		servers = serve(p)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		// Loop through all targets and start probes concurrently
-		for n, target := range listOfTargets {
-			s := strings.Split(target, ":")
-			if len(s) < 2 {
-				log.Printf("target %s was not in correct format", target)
-				os.Exit(1)
-			}
-			// Only mount to the "prober" directory. This should not be changed.
-			mountPoint := fmt.Sprintf("%s/%s", s[1], "prober")
-			address := s[0]
-			// Make all local directories needed for mounting
-			os.MkdirAll(fmt.Sprintf("%s/%s", *localMountLocation, address), os.ModePerm)
-			newTarget := &nfs{
-				address:    address,
-				mountPoint: mountPoint,
-				log:        newLog,
-			}
-			// Wait a random amount of time from 0 - 30s so targets don't start at the same time
-			mrand.Seed(time.Now().UnixNano() + int64(n))
-			time.Sleep(time.Duration(mrand.Intn(30)) * time.Second)
-			go newTarget.test(ctx)
+		sig := <-signals
+		logrus.Info(fmt.Sprintf("received %s, shutting down", sig))
+		// Finish in-flight requests before Run returns and unmounts the targets
+		shutdown(servers)
+		cancel()
+	}()
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			logrus.Info("received hangup, reloading targets")
+			reload(p)
 		}
 	}()
-	ready = true
+	if *watchConfigFile && *configFile != "" {
+		go watchConfig(ctx, *configFile, func() { reload(p) })
+	}
+	// Returns on SIGINT or SIGTERM or after max_runtime
+	p.Run(ctx)
+	shutdown(servers)
+}
+
+// reload reads --targets and the config file again and replaces the prober's targets
+// with them, the targets are left as they are if anything is invalid.
+func reload(p *prober.Prober) {
+	if *configFile == "" {
+		logrus.Warn("no config_file to reload targets from")
+		return
+	}
+	var config prober.Config
+	var err error
+	if *targets != "" {
+		config.Targets, err = prober.ParseTargets(*targets)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Warn("could not reload targets")
+			return
+		}
+	}
+	file, err := prober.LoadConfigFile(*configFile)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Warn("could not reload targets")
+		return
+	}
+	file.Apply(&config)
+	if err := p.SetTargets(config.Targets, config.TargetOptions); err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Warn("could not reload targets")
+	}
+}
+
+// reloadDebounce is how long the config file has to be left alone before it's reloaded,
+// an update is usually several events.
+const reloadDebounce = time.Second
+
+// watchConfig calls reload when the file at path changes until ctx is done. Kubernetes
+// updates a ConfigMap by swapping a symlink in the file's directory rather than writing
+// the file, so the directory is watched and a change of where path resolves to counts.
+func watchConfig(ctx context.Context, path string, reload func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Warn("could not watch config file")
+		return
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		logrus.WithFields(logrus.Fields{"err": err, "file": path}).Warn("could not watch config file")
+		return
+	}
+	resolved, _ := filepath.EvalSymlinks(path)
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			logrus.WithFields(logrus.Fields{"err": err, "file": path}).Warn("error watching config file")
+		case event := <-watcher.Events:
+			current, _ := filepath.EvalSymlinks(path)
+			if filepath.Clean(event.Name) != filepath.Clean(path) && current == resolved {
+				continue
+			}
+			resolved = current
+			debounce.Reset(reloadDebounce)
+		case <-debounce.C:
+			logrus.WithFields(logrus.Fields{"file": path}).Info("config file changed, reloading targets")
+			reload()
+		}
+	}
+}
+
+// shutdownGrace is how long in-flight requests get to finish on shutdown.
+const shutdownGrace = 10 * time.Second
+
+// shutdown stops servers accepting connections and waits for in-flight requests.
+func shutdown(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logrus.Warn(fmt.Sprintf("HTTP endpoint shutdown: %v", err))
+		}
+	}
+}
+
+// serve registers the endpoints and serves them on every listen address in the
+// background until shut down.
+func serve(p *prober.Prober) []*http.Server {
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/ready", readyHandler(p))
+	http.HandleFunc("/status", statusHandler(p))
+	http.HandleFunc("/config", configHandler(p))
+	if *historySize > 0 {
+		http.HandleFunc("/history", historyHandler(p))
+	}
+	http.HandleFunc("/target/enable", targetHandler(p, true))
+	http.HandleFunc("/target/disable", targetHandler(p, false))
+	if *failureInjection {
+		http.HandleFunc("/debug/inject", injectHandler(p))
+	}
+	if *onDemand {
+		// Probes on request would overlap with the background probes otherwise
+		http.HandleFunc("/probe", probeHandler(p))
+	}
 	if *usePrometheus {
-		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/metrics", metricsHandler(prometheus.DefaultRegisterer, prometheus.DefaultGatherer))
+	}
+	addresses := []string{fmt.Sprintf(":%d", *webPort)}
+	if *listenAddress != "" {
+		addresses = strings.Split(*listenAddress, ",")
+	}
+	var servers []*http.Server
+	for _, address := range addresses {
+		// Listen before serving so an address that can't be bound stops the prober at startup
+		listener, err := net.Listen("tcp", strings.TrimSpace(address))
+		if err != nil {
+			log.Fatal(err)
+		}
+		logrus.Info(fmt.Sprintf("starting HTTP endpoint on %s", listener.Addr()))
+		server := &http.Server{}
+		go func() {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		servers = append(servers, server)
 	}
-	logrus.Info(fmt.Sprintf("starting HTTP endpoint on :%d", *webPort))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *webPort), nil))
+	return servers
 }
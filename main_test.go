@@ -0,0 +1,170 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ddlfcloud/nfs-prober/prober"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "default"},
+		{name: "environment over default", env: "env", want: "env"},
+		{name: "flag over environment", arg: "flag", env: "env", want: "flag"},
+		{name: "flag over default", arg: "flag", want: "flag"},
+	}
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			value := flag.String("test_value", "default", "")
+			var args []string
+			if tt.arg != "" {
+				args = append(args, "-test_value="+tt.arg)
+			}
+			if err := flag.CommandLine.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			os.Unsetenv(envPrefix + "TEST_VALUE")
+			if tt.env != "" {
+				os.Setenv(envPrefix+"TEST_VALUE", tt.env)
+				defer os.Unsetenv(envPrefix + "TEST_VALUE")
+			}
+			if err := setFlagsFromEnv(); err != nil {
+				t.Fatalf("setFlagsFromEnv() = %v", err)
+			}
+			if *value != tt.want {
+				t.Errorf("test_value = %q, want %q", *value, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetFlagsFromEnvInvalid(t *testing.T) {
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.Int("test_count", 1, "")
+	os.Setenv(envPrefix+"TEST_COUNT", "many")
+	defer os.Unsetenv(envPrefix + "TEST_COUNT")
+	if err := setFlagsFromEnv(); err == nil {
+		t.Error("setFlagsFromEnv() succeeded with an invalid integer")
+	}
+}
+
+func TestMetricsHandlerCompression(t *testing.T) {
+	tests := []struct {
+		name               string
+		disableCompression bool
+		acceptEncoding     string
+		wantEncoding       string
+	}{
+		{name: "gzip accepted", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{name: "gzip not accepted", wantEncoding: ""},
+		{name: "compression disabled", disableCompression: true, acceptEncoding: "gzip", wantEncoding: ""},
+	}
+	defer func(disabled bool) { *disableCompression = disabled }(*disableCompression)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*disableCompression = tt.disableCompression
+			registry := prometheus.NewRegistry()
+			handler := metricsHandler(registry, registry)
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			var body io.Reader = rec.Body
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader() = %v", err)
+				}
+				body = gz
+			}
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "nfs_prober_up 1") {
+				t.Errorf("payload doesn't contain nfs_prober_up:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestResultReporter(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	registry := prometheus.NewRegistry()
+	report := resultReporter(log, registry)
+	target := prober.Target{Address: "10.0.0.1", MountPoint: "/export"}
+	report(prober.Result{
+		Target:  target,
+		CycleID: "5b1e0c7a",
+		Writes:  []prober.FileResult{{File: "/mnt/0"}, {File: "/mnt/1", Err: &prober.ProbeError{Op: "write", Target: target, File: "/mnt/1", Reason: "io_error", Err: syscall.EIO}}},
+		Reads:   []prober.FileResult{{File: "/mnt/0"}},
+	})
+	entries := hook.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries, want 1 for the failed write", len(entries))
+	}
+	if entries[0].Message != "could not write test file" || entries[0].Data["file"] != "/mnt/1" || entries[0].Data["cycle_id"] != "5b1e0c7a" || entries[0].Data["reason"] != "io_error" {
+		t.Errorf("logged %q with %v, want the failed write", entries[0].Message, entries[0].Data)
+	}
+	expected := `
+# HELP nfs_probe_errors_total failed mounts, test file writes and reads by operation and reason
+# TYPE nfs_probe_errors_total counter
+nfs_probe_errors_total{address="10.0.0.1",mount_point="/export",op="write",reason="io_error"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,111 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testAppendName is the name of the file the append test appends to.
+const testAppendName = ".prober-append"
+
+// appendTest appends a record to the append test file with O_APPEND and checks that
+// the file grew by exactly the record and that it reads back intact at the old end of
+// the file. The file is truncated first every AppendTruncateEvery appends.
+func (n *nfs) appendTest(ctx context.Context) *FileResult {
+	file := fmt.Sprintf("%s/%s", n.localDir(), testAppendName)
+	record := []byte(fmt.Sprintf("%s %d\n", newCycleID(), time.Now().UnixNano()))
+	n.mu.Lock()
+	truncate := n.appends%n.config.AppendTruncateEvery == 0
+	n.appends++
+	n.mu.Unlock()
+	startTime := time.Now()
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+			if truncate {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(file, flags, n.config.TestFileMode)
+			if err != nil {
+				return err
+			}
+			before, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			written, err := f.Write(record)
+			n.countWritten(written)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			after, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			if after.Size() != before.Size()+int64(len(record)) {
+				return fmt.Errorf("append grew file from %d to %d bytes, expected %d", before.Size(), after.Size(), before.Size()+int64(len(record)))
+			}
+			f, err = os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			got := make([]byte, len(record))
+			read, err := f.ReadAt(got, before.Size())
+			n.countRead(read)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, record) {
+				return fmt.Errorf("appended record read back as %q, expected %q", got, record)
+			}
+			return nil
+		})
+	})
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": file}).Warn("could not append to test file")
+		if n.config.UsePrometheus {
+			n.metrics.appendAttempts.WithLabelValues(n.labels("false")...).Observe(duration)
+		}
+		return &FileResult{File: file, Duration: elapsed, Err: err}
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": file, "truncated": truncate}).Info("appended to test file")
+	if n.config.UsePrometheus {
+		n.metrics.appendAttempts.WithLabelValues(n.labels("true")...).Observe(duration)
+	}
+	return &FileResult{File: file, Duration: elapsed}
+}
@@ -0,0 +1,91 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states, the values of nfs_breaker_state.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// breakerAllows is whether the target should be probed now. An open breaker skips
+// probes until its backoff has passed, then lets one through half-open.
+func (n *nfs) breakerAllows() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.breakerState != breakerOpen {
+		return true
+	}
+	if time.Now().Before(n.breakerUntil) {
+		return false
+	}
+	n.setBreakerState(breakerHalfOpen)
+	return true
+}
+
+// updateBreaker opens the breaker once the target has failed BreakerThreshold times in
+// a row, backing off twice as long for every further failure up to BreakerMaxInterval,
+// and closes it on the first success.
+func (n *nfs) updateBreaker(ctx context.Context, result Result) {
+	if n.config.BreakerThreshold <= 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if result.Err() == nil {
+		n.breakerUntil = time.Time{}
+		n.setBreakerState(breakerClosed)
+		return
+	}
+	if n.consecutiveFailures < n.config.BreakerThreshold {
+		return
+	}
+	backoff := n.config.Interval
+	for i := n.config.BreakerThreshold; i <= n.consecutiveFailures && backoff < n.config.BreakerMaxInterval; i++ {
+		backoff *= 2
+	}
+	if backoff > n.config.BreakerMaxInterval {
+		backoff = n.config.BreakerMaxInterval
+	}
+	n.breakerUntil = time.Now().Add(backoff)
+	if n.breakerState != breakerOpen {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "failures": n.consecutiveFailures, "backoff": backoff.Seconds()}).Warn("circuit breaker open, backing off probes")
+	}
+	n.setBreakerState(breakerOpen)
+}
+
+// setBreakerState must be called with mu held.
+func (n *nfs) setBreakerState(state int) {
+	n.breakerState = state
+	if n.config.UsePrometheus {
+		n.metrics.breakerState.WithLabelValues(n.labels()...).Set(float64(state))
+	}
+}
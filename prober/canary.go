@@ -0,0 +1,114 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// validateCanary checks a canary file is a path inside the prober directory and its
+// checksum, when given, is a hex SHA-256.
+func validateCanary(file string, checksum string) error {
+	if file == "" {
+		if checksum != "" {
+			return errors.New("canary sha256 needs a canary file")
+		}
+		return nil
+	}
+	if filepath.IsAbs(file) {
+		return fmt.Errorf("canary file %s must be relative to the prober directory", file)
+	}
+	for _, part := range strings.Split(file, "/") {
+		if part == ".." {
+			return fmt.Errorf("canary file %s can't contain ..", file)
+		}
+	}
+	if b, err := hex.DecodeString(checksum); checksum != "" && (err != nil || len(b) != sha256.Size) {
+		return fmt.Errorf("canary sha256 %s must be 64 hex digits", checksum)
+	}
+	return nil
+}
+
+// readCanary reads the canary file seeded on the export, checking its SHA-256 when one
+// is expected, in place of the test files. Nothing is written.
+func (n *nfs) readCanary(ctx context.Context) FileResult {
+	file := filepath.Join(n.localDir(), n.canaryFile)
+	startTime := time.Now()
+	var sum []byte
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			hash := sha256.New()
+			read, err := io.Copy(hash, f)
+			n.countRead(int(read))
+			sum = hash.Sum(nil)
+			return err
+		})
+	})
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	if err == nil && n.canarySHA256 != "" {
+		// Validated by New
+		expected, _ := hex.DecodeString(n.canarySHA256)
+		match := bytes.Equal(sum, expected)
+		if n.config.UsePrometheus {
+			value := 0.0
+			if match {
+				value = 1
+			}
+			n.metrics.canaryMatch.WithLabelValues(n.labels()...).Set(value)
+		}
+		if !match {
+			err = fmt.Errorf("canary file sha256 is %x, expected %s", sum, n.canarySHA256)
+		}
+	}
+	if err != nil {
+		if n.config.UsePrometheus {
+			n.metrics.readAttempts.WithLabelValues(n.labels(file, "false", n.proto())...).Observe(duration)
+		}
+		return FileResult{File: file, Duration: elapsed, Err: newProbeError("read", n.target, file, err)}
+	}
+	if !n.config.QuietReads {
+		n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": file}).Info("read canary file")
+	}
+	if n.config.UsePrometheus {
+		n.metrics.readAttempts.WithLabelValues(n.labels(file, "true", n.proto())...).Observe(duration)
+	}
+	return FileResult{File: file, Duration: elapsed}
+}
@@ -0,0 +1,73 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// secretFields are Config fields that are redacted from the effective config.
+var secretFields = map[string]bool{
+	"WebhookURL": true,
+}
+
+// EffectiveConfig returns the config the prober is running with, after defaults are
+// applied, as a map of field name to a JSON friendly value. Durations and file modes
+// are strings, secrets are redacted and fields that aren't plain settings, like the
+// logger and registry, are left out.
+func (p *Prober) EffectiveConfig() map[string]interface{} {
+	effective := map[string]interface{}{}
+	p.mu.Lock()
+	v := reflect.ValueOf(p.config)
+	p.mu.Unlock()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		field := v.Field(i)
+		switch value := field.Interface().(type) {
+		case time.Duration:
+			effective[name] = value.String()
+		case os.FileMode:
+			effective[name] = fmt.Sprintf("%#o", uint32(value))
+		case map[Target]TargetOptions:
+			// JSON object keys have to be strings
+			options := map[string]TargetOptions{}
+			for target, option := range value {
+				options[target.String()] = option
+			}
+			effective[name] = options
+		default:
+			switch field.Kind() {
+			case reflect.Interface, reflect.Ptr, reflect.Func, reflect.Chan:
+				continue
+			}
+			effective[name] = value
+		}
+		if secretFields[name] && !field.IsZero() {
+			effective[name] = "<redacted>"
+		}
+	}
+	return effective
+}
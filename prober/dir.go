@@ -0,0 +1,113 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// testDirPrefix starts the name of the directories created by the mkdir test.
+const testDirPrefix = ".prober-dir-"
+
+// dirTest creates a uniquely named directory in the prober directory, stats it and
+// removes it again, returning the mkdir and rmdir results. mkdir and rmdir can fail on
+// their own, eg because of ACLs, while file writes succeed.
+func (n *nfs) dirTest(ctx context.Context, id string) []FileResult {
+	n.removeStaleTestDirs(ctx)
+	dir := fmt.Sprintf("%s/%s%s", n.localDir(), testDirPrefix, id)
+	mkdir := n.timeDirOp(ctx, "mkdir", dir, n.metrics.mkdirAttempts, func() error {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		_, err := os.Stat(dir)
+		return err
+	})
+	if mkdir.Err != nil {
+		return []FileResult{mkdir}
+	}
+	rmdir := n.timeDirOp(ctx, "rmdir", dir, n.metrics.rmdirAttempts, func() error {
+		return os.Remove(dir)
+	})
+	return []FileResult{mkdir, rmdir}
+}
+
+// timeDirOp runs and times a directory operation, recording it in histogram.
+func (n *nfs) timeDirOp(ctx context.Context, op string, dir string, histogram *prometheus.HistogramVec, fn func() error) FileResult {
+	startTime := time.Now()
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(fn)
+	})
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": dir}).Warn("could not " + op + " test directory")
+		if n.config.UsePrometheus {
+			histogram.WithLabelValues(n.labels("false")...).Observe(duration)
+		}
+		return FileResult{File: dir, Duration: elapsed, Err: err}
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": dir}).Info(op + " test directory")
+	if n.config.UsePrometheus {
+		histogram.WithLabelValues(n.labels("true")...).Observe(duration)
+	}
+	return FileResult{File: dir, Duration: elapsed}
+}
+
+// removeStaleTestDirs removes test directories left behind by a crashed or timed out probe.
+func (n *nfs) removeStaleTestDirs(ctx context.Context) {
+	var entries []os.FileInfo
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			var err error
+			entries, err = ioutil.ReadDir(n.localDir())
+			return err
+		})
+	})
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), testDirPrefix) {
+			continue
+		}
+		dir := fmt.Sprintf("%s/%s", n.localDir(), entry.Name())
+		err := withContext(ctx, func() error {
+			return n.asTestIdentity(func() error {
+				return os.Remove(dir)
+			})
+		})
+		if err != nil && !os.IsNotExist(err) {
+			n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "file": dir}).Warn("could not remove stale test directory")
+			continue
+		}
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "file": dir}).Info("removed stale test directory")
+	}
+}
@@ -0,0 +1,72 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errDNS is wrapped by the error of a failed lookup of a hostname target.
+var errDNS = errors.New("could not resolve target address")
+
+// resolve returns the IP address the target is mounted from, the kernel doesn't
+// resolve hostnames itself. An IP address is used as it is, a hostname is looked up
+// within DNSTimeout and the result cached for DNSCacheTTL. The lookup is timed in
+// nfs_dns_resolve_seconds so a slow resolver isn't mistaken for a slow mount.
+func (n *nfs) resolve(ctx context.Context) (string, error) {
+	if net.ParseIP(n.address) != nil {
+		return n.address, nil
+	}
+	n.mu.Lock()
+	cached, resolvedAt := n.resolvedAddress, n.resolvedAt
+	n.mu.Unlock()
+	if cached != "" && time.Since(resolvedAt) < n.config.DNSCacheTTL {
+		return cached, nil
+	}
+	if n.config.DNSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.config.DNSTimeout)
+		defer cancel()
+	}
+	startTime := time.Now()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, n.address)
+	duration := time.Since(startTime).Seconds()
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses found")
+	}
+	if n.config.UsePrometheus {
+		n.metrics.dnsResolve.WithLabelValues(n.labels(fmt.Sprint(err == nil))...).Observe(duration)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w %s: %v", errDNS, n.address, err)
+	}
+	address := addrs[0].IP.String()
+	n.mu.Lock()
+	n.resolvedAddress, n.resolvedAt = address, time.Now()
+	n.mu.Unlock()
+	return address, nil
+}
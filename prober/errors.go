@@ -0,0 +1,176 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errorReasons maps the errnos worth telling apart to metric label values.
+var errorReasons = map[syscall.Errno]string{
+	syscall.ECONNREFUSED: "connection_refused",
+	syscall.ETIMEDOUT:    "timeout",
+	syscall.EHOSTUNREACH: "host_unreachable",
+	syscall.ENETUNREACH:  "network_unreachable",
+	syscall.EACCES:       "permission_denied",
+	syscall.EPERM:        "not_permitted",
+	syscall.ESTALE:       "stale_handle",
+	syscall.ENOENT:       "not_found",
+	syscall.EBUSY:        "busy",
+	syscall.EIO:          "io_error",
+	syscall.EROFS:        "read_only",
+	syscall.EAGAIN:       "try_again",
+}
+
+// DefaultMountRetryErrnos are the transient mount errors retried when MountRetryErrnos
+// isn't set.
+var DefaultMountRetryErrnos = []syscall.Errno{syscall.ETIMEDOUT, syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.EAGAIN}
+
+// ParseErrnos parses a comma separated list of errno names, eg ETIMEDOUT,EAGAIN.
+func ParseErrnos(list string) ([]syscall.Errno, error) {
+	errnos := []syscall.Errno{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		errno, ok := errnoByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown errno %s", name)
+		}
+		errnos = append(errnos, errno)
+	}
+	return errnos, nil
+}
+
+func errnoByName(name string) (syscall.Errno, bool) {
+	// Errnos are small, every one has a number below 256
+	for errno := syscall.Errno(1); errno < 256; errno++ {
+		if unix.ErrnoName(errno) == name {
+			return errno, true
+		}
+	}
+	return 0, false
+}
+
+// errnoName is the name of the errno in err, or "" if it doesn't have one.
+func errnoName(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return unix.ErrnoName(errno)
+	}
+	return ""
+}
+
+// errorReason classifies err into a small set of label values, anything unknown is
+// "other" to keep the label cardinality bounded.
+func errorReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, errNotInMountTable) {
+		return "not_in_mount_table"
+	}
+	if errors.Is(err, errVersionMismatch) {
+		return "version_mismatch"
+	}
+	if errors.Is(err, errDNS) {
+		return "dns"
+	}
+	if errors.Is(err, errInjected) {
+		return "injected"
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if reason, ok := errorReasons[errno]; ok {
+			return reason
+		}
+	}
+	return "other"
+}
+
+// ProbeError is a failed operation of a probe cycle. Every error in a Result is one,
+// as is the error returned by Probe. It unwraps to the underlying error, so errors.Is
+// matches the errno it failed with, eg syscall.ESTALE, or os.ErrNotExist and
+// os.ErrPermission for the common ones.
+type ProbeError struct {
+	// Op is the operation that failed, mount, stat, dir, symlink, append, write, chmod,
+	// read or verify
+	Op     string
+	Target Target
+	// File is the file or directory the operation failed on, empty for a mount
+	File string
+	// Errno is the errno the operation failed with, 0 if it didn't fail with one
+	Errno syscall.Errno
+	// Reason classifies the error like the reason label of nfs_mount_errors_total
+	Reason string
+	Err    error
+}
+
+func (e *ProbeError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s %s %s: %v", e.Op, e.Target, e.File, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// newProbeError wraps err of op in a ProbeError classified by errorReason, nil stays
+// nil and a ProbeError isn't wrapped again.
+func newProbeError(op string, target Target, file string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var probeErr *ProbeError
+	if errors.As(err, &probeErr) {
+		return err
+	}
+	probeErr = &ProbeError{Op: op, Target: target, File: file, Reason: errorReason(err), Err: err}
+	errors.As(err, &probeErr.Errno)
+	return probeErr
+}
+
+// wrapErrors replaces every error in result that isn't a ProbeError yet with one of
+// its operation.
+func wrapErrors(result *Result) {
+	result.MountErr = newProbeError("mount", result.Target, "", result.MountErr)
+	for op, r := range map[string]*FileResult{"stat": result.Stat, "symlink": result.Symlink, "append": result.Append} {
+		if r != nil {
+			r.Err = newProbeError(op, result.Target, r.File, r.Err)
+		}
+	}
+	for op, results := range map[string][]FileResult{"dir": result.Dirs, "write": result.Writes, "chmod": result.Chmods, "read": result.Reads, "verify": result.Verifies} {
+		for i := range results {
+			results[i].Err = newProbeError(op, result.Target, results[i].File, results[i].Err)
+		}
+	}
+}
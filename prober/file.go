@@ -0,0 +1,205 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// FileConfig is the layout of the JSON config file, it adds targets and their settings
+// to the ones given on the command line.
+type FileConfig struct {
+	Targets []FileTarget `json:"targets"`
+}
+
+// FileTarget is a target and its settings in the config file.
+type FileTarget struct {
+	Address    string `json:"address"`
+	MountPoint string `json:"mount_point"`
+	// Variant tells apart targets with the same address and mount point, it's added
+	// to the metric series of every target as the variant label
+	Variant string `json:"variant,omitempty"`
+	// MountOptions are added after --mount_options and take precedence
+	MountOptions string `json:"mount_options,omitempty"`
+	// NumOfTestFiles replaces --num_of_files for the target
+	NumOfTestFiles int `json:"num_files,omitempty"`
+	// Path is where the export is already mounted, probed with --use_existing_mount
+	Path string `json:"path,omitempty"`
+	// CanaryFile and CanarySHA256 replace --canary_file and --canary_sha256
+	CanaryFile   string `json:"canary_file,omitempty"`
+	CanarySHA256 string `json:"canary_sha256,omitempty"`
+	// Enabled defaults to true, a disabled target is configured but isn't probed
+	Enabled *bool `json:"enabled,omitempty"`
+	// Labels are added to every metric series of the target
+	Labels map[string]string `json:"labels,omitempty"`
+	// Ops are the operations run against the target instead of the global settings
+	Ops []string `json:"ops,omitempty"`
+}
+
+// TargetOptions are the settings of a single target.
+type TargetOptions struct {
+	// Disabled targets aren't probed until enabled at runtime
+	Disabled bool
+	// Labels are added to every metric series of the target, targets without one
+	// of the labels used by another target get an empty value
+	Labels map[string]string
+	// Ops are the operations run against the target after mounting, replacing the
+	// global settings, one of Ops. Nil uses the global settings
+	Ops []string
+	// MountOptions are comma separated mount options added after the global ones
+	MountOptions string
+	// NumOfTestFiles replaces the global NumOfTestFiles when it's more than zero
+	NumOfTestFiles int
+	// Path is the local directory the target is already mounted on, probed instead of
+	// mounting with UseExistingMount. Empty uses the directory the prober would mount on
+	Path string
+	// CanaryFile replaces the global CanaryFile when set, along with CanarySHA256
+	CanaryFile   string
+	CanarySHA256 string
+}
+
+// Ops are the operations that can be chosen per target. read without write reads
+// pre-seeded test files.
+var Ops = []string{"stat", "dir", "symlink", "append", "write", "chmod", "read"}
+
+func validOp(op string) bool {
+	for _, valid := range Ops {
+		if op == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedLabels are the label names the prober's own metrics use.
+var reservedLabels = map[string]bool{
+	"address":     true,
+	"mount_point": true,
+	"test_file":   true,
+	"success":     true,
+	"reason":      true,
+	"proto":       true,
+	"lazy":        true,
+	"phase":       true,
+	"version":     true,
+	"variant":     true,
+	"path":        true,
+}
+
+// targetLabelNames returns the sorted names of every custom target label, and variant
+// when any target has one.
+func targetLabelNames(targets []Target, options map[Target]TargetOptions) ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, target := range targets {
+		if target.Variant != "" && !seen["variant"] {
+			seen["variant"] = true
+			names = append(names, "variant")
+		}
+	}
+	for target, option := range options {
+		for name := range option.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("target %s has an invalid label name %q", target, name)
+			}
+			if reservedLabels[name] {
+				return nil, fmt.Errorf("target %s label %q is used by the prober's metrics", target, name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadConfigFile reads and validates the JSON config file at path.
+func LoadConfigFile(path string) (*FileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+	var file FileConfig
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	for i, target := range file.Targets {
+		if target.Address == "" || target.MountPoint == "" {
+			return nil, fmt.Errorf("invalid config file %s: target %d needs an address and mount_point", path, i)
+		}
+		if err := ValidateTarget(Target{Address: target.Address, MountPoint: target.MountPoint, Variant: target.Variant}); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		if target.NumOfTestFiles < 0 || target.NumOfTestFiles > 5 {
+			return nil, fmt.Errorf("invalid config file %s: target %d num_files must be between 1 and 5", path, i)
+		}
+		if _, err := parseMountOptions(target.MountOptions); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: target %d: %v", path, i, err)
+		}
+		if err := validateCanary(target.CanaryFile, target.CanarySHA256); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: target %d: %v", path, i, err)
+		}
+		if target.Path != "" && !filepath.IsAbs(target.Path) {
+			return nil, fmt.Errorf("invalid config file %s: target %d path must be absolute", path, i)
+		}
+		for _, op := range target.Ops {
+			if !validOp(op) {
+				return nil, fmt.Errorf("invalid config file %s: target %d has unknown op %q, ops are %s", path, i, op, strings.Join(Ops, ", "))
+			}
+		}
+	}
+	return &file, nil
+}
+
+// Apply adds the targets in the file and their settings to config.
+func (f *FileConfig) Apply(config *Config) {
+	if config.TargetOptions == nil {
+		config.TargetOptions = map[Target]TargetOptions{}
+	}
+	for _, fileTarget := range f.Targets {
+		target := Target{Address: fileTarget.Address, MountPoint: fileTarget.MountPoint, Variant: fileTarget.Variant}
+		config.Targets = append(config.Targets, target)
+		config.TargetOptions[target] = TargetOptions{
+			Disabled:       fileTarget.Enabled != nil && !*fileTarget.Enabled,
+			Labels:         fileTarget.Labels,
+			Ops:            fileTarget.Ops,
+			MountOptions:   fileTarget.MountOptions,
+			NumOfTestFiles: fileTarget.NumOfTestFiles,
+			Path:           fileTarget.Path,
+			CanaryFile:     fileTarget.CanaryFile,
+			CanarySHA256:   fileTarget.CanarySHA256,
+		}
+	}
+}
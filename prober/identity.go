@@ -0,0 +1,61 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// asTestIdentity runs fn with the filesystem uid and gid set to TestUID and TestGID,
+// so root-squash and export permissions apply as they would to that user. The fs ids
+// belong to the OS thread, so fn runs locked to a thread that only goes back to the
+// pool once they are restored.
+func (n *nfs) asTestIdentity(fn func() error) error {
+	if n.config.TestUID == 0 && n.config.TestGID == 0 {
+		return fn()
+	}
+	runtime.LockOSThread()
+	// Set the gid first, changing the uid away from root can drop the right to change it
+	prevGID, _ := unix.SetfsgidRetGid(n.config.TestGID)
+	prevUID, _ := unix.SetfsuidRetUid(n.config.TestUID)
+	// An invalid id returns the current one without changing it
+	uid, _ := unix.SetfsuidRetUid(-1)
+	gid, _ := unix.SetfsgidRetGid(-1)
+	if uid != n.config.TestUID || gid != n.config.TestGID {
+		unix.SetfsuidRetUid(prevUID)
+		unix.SetfsgidRetGid(prevGID)
+		runtime.UnlockOSThread()
+		return fmt.Errorf("could not switch to uid %d gid %d", n.config.TestUID, n.config.TestGID)
+	}
+	err := fn()
+	unix.SetfsuidRetUid(prevUID)
+	unix.SetfsgidRetGid(prevGID)
+	if uid, _ := unix.SetfsuidRetUid(-1); uid == prevUID {
+		// Otherwise the thread exits with the goroutine rather than run anything else
+		runtime.UnlockOSThread()
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errInjected is the mount error of a probe failed by InjectFailure.
+var errInjected = errors.New("injected failure")
+
+// InjectFailure makes the next cycles probes of target fail without touching the
+// export, so alerting can be tested end to end. The failures go through the same
+// accounting as real ones, with the injected reason. Zero cycles stops an injection.
+func (p *Prober) InjectFailure(target Target, cycles int) error {
+	n := p.lookup(target)
+	if n == nil {
+		return fmt.Errorf("target %s is not configured", target)
+	}
+	n.mu.Lock()
+	n.injectCycles = cycles
+	n.mu.Unlock()
+	n.log.WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "cycles": cycles, "injected": true}).Warn("failure injection set")
+	return nil
+}
+
+// injectedFailure fails the mount of the cycle if a failure was injected, recording it
+// like a real failed mount.
+func (n *nfs) injectedFailure(ctx context.Context) error {
+	n.mu.Lock()
+	inject := n.injectCycles > 0
+	if inject {
+		n.injectCycles--
+	}
+	n.mu.Unlock()
+	if !inject {
+		return nil
+	}
+	n.statusDown()
+	if n.config.UsePrometheus {
+		n.metrics.mountErrors.WithLabelValues(n.labels("injected")...).Inc()
+	}
+	return newProbeError("mount", n.target, "", errInjected)
+}
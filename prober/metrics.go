@@ -0,0 +1,274 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	// targetLabels are the names of the custom target labels of every per target metric
+	targetLabels          []string
+	status                *prometheus.GaugeVec
+	mountAttempts         *prometheus.HistogramVec
+	readAttempts          *prometheus.HistogramVec
+	writeAttempts         *prometheus.HistogramVec
+	fileModeMatch         *prometheus.GaugeVec
+	chmodAttempts         *prometheus.HistogramVec
+	mountHung             *prometheus.GaugeVec
+	mountSlow             *prometheus.CounterVec
+	testFilesPresent      *prometheus.GaugeVec
+	probeInProgress       *prometheus.GaugeVec
+	statAttempts          *prometheus.HistogramVec
+	mountErrors           *prometheus.CounterVec
+	verifyMatchRatio      *prometheus.GaugeVec
+	serverReachable       *prometheus.GaugeVec
+	targetDisabled        *prometheus.GaugeVec
+	timeToFirstSuccess    *prometheus.GaugeVec
+	localSetupFailures    *prometheus.CounterVec
+	staleHandleRecoveries *prometheus.CounterVec
+	unmountRetries        *prometheus.CounterVec
+	mountSuccessRatio     *prometheus.GaugeVec
+	readSuccessRatio      *prometheus.GaugeVec
+	writeSuccessRatio     *prometheus.GaugeVec
+	writesSkipped         *prometheus.GaugeVec
+	mkdirAttempts         *prometheus.HistogramVec
+	rmdirAttempts         *prometheus.HistogramVec
+	symlinkAttempts       *prometheus.HistogramVec
+	unmountAttempts       *prometheus.HistogramVec
+	version               *prometheus.GaugeVec
+	breakerState          *prometheus.GaugeVec
+	mtimeSkew             *prometheus.GaugeVec
+	goroutineRestarts     *prometheus.CounterVec
+	bytesWritten          *prometheus.CounterVec
+	bytesRead             *prometheus.CounterVec
+	mountRetries          *prometheus.CounterVec
+	scheduleDrift         *prometheus.GaugeVec
+	dataPathStatus        *prometheus.GaugeVec
+	dnsResolve            *prometheus.HistogramVec
+	appendAttempts        *prometheus.HistogramVec
+	canaryMatch           *prometheus.GaugeVec
+	sampledProbes         *prometheus.CounterVec
+}
+
+// newMetrics registers the metrics on the config's registry, every per target metric
+// has the address and mount_point labels, its own labels and then targetLabels.
+func newMetrics(config Config, targetLabels []string) *metrics {
+	factory := promauto.With(config.Registry)
+	labels := func(names ...string) []string {
+		all := append([]string{"address", "mount_point"}, names...)
+		return append(all, targetLabels...)
+	}
+	return &metrics{
+		targetLabels: targetLabels,
+		status: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_status",
+			Help: "current mount status of an NFS target",
+		}, labels()),
+		mountAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_mount_attempts_seconds",
+			Help:    "attempts made to connect to an NFS target",
+			Buckets: config.LatencyBuckets,
+		}, labels("success", "proto")),
+		readAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_read_attempts_seconds",
+			Help:    "attempts to read a file from a target NFS instance",
+			Buckets: config.ReadBuckets,
+		}, labels("test_file", "success", "proto")),
+		writeAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_write_attempts_seconds",
+			Help:    "attempts to write a file to a target NFS instance",
+			Buckets: config.WriteBuckets,
+		}, labels("test_file", "success", "proto")),
+		fileModeMatch: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_test_file_mode_match",
+			Help: "whether the mode of a written test file matches the requested mode",
+		}, labels("test_file")),
+		chmodAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_chmod_attempts_seconds",
+			Help:    "attempts to chmod a test file on a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("test_file", "success")),
+		mountHung: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_mount_hung",
+			Help: "whether a mount syscall to an NFS target is blocked past the hang threshold",
+		}, labels()),
+		mountSlow: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_mount_slow_total",
+			Help: "successful mounts to an NFS target that took longer than the max mount duration",
+		}, labels()),
+		testFilesPresent: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_test_files_present",
+			Help: "number of test files in the prober directory of an NFS target, counted after probes that write",
+		}, labels()),
+		probeInProgress: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_probe_in_progress",
+			Help: "whether a probe cycle against an NFS target is currently running",
+		}, labels()),
+		statAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_stat_attempts_seconds",
+			Help:    "attempts to stat the prober directory of a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		mountErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_mount_errors_total",
+			Help: "failed mounts to an NFS target by reason",
+		}, labels("reason")),
+		verifyMatchRatio: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_verify_match_ratio",
+			Help: "fraction of write then read verification rounds in the last probe whose content matched",
+		}, labels()),
+		serverReachable: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_server_reachable",
+			Help: "whether the NFS port of a server accepted a TCP connection before mounting",
+		}, []string{"address"}),
+		targetDisabled: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_target_disabled",
+			Help: "whether probing an NFS target is paused",
+		}, labels()),
+		timeToFirstSuccess: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_time_to_first_success_seconds",
+			Help: "seconds from the prober starting to the first successful mount of an NFS target",
+		}, labels()),
+		localSetupFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_local_setup_failures_total",
+			Help: "failures to create the local directory an NFS target is mounted on",
+		}, labels()),
+		staleHandleRecoveries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_stale_handle_recoveries_total",
+			Help: "remounts of an NFS target after a test file operation returned a stale file handle",
+		}, labels()),
+		unmountRetries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_unmount_retries_total",
+			Help: "retried unmounts of an NFS target before mounting, by whether it fell back to a lazy unmount",
+		}, labels("lazy")),
+		mountSuccessRatio: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_mount_success_ratio",
+			Help: "fraction of successful mounts of an NFS target over the last success window probes",
+		}, labels()),
+		readSuccessRatio: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_read_success_ratio",
+			Help: "fraction of successful reads of an NFS target over the last success window probes",
+		}, labels()),
+		writeSuccessRatio: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_write_success_ratio",
+			Help: "fraction of successful writes of an NFS target over the last success window probes",
+		}, labels()),
+		writesSkipped: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_writes_skipped",
+			Help: "whether writes to an NFS target are skipped because it is mounted read-only",
+		}, labels()),
+		mkdirAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_mkdir_attempts_seconds",
+			Help:    "attempts to create and stat a directory on a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		rmdirAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_rmdir_attempts_seconds",
+			Help:    "attempts to remove a directory on a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		symlinkAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_symlink_attempts_seconds",
+			Help:    "attempts to create, read and remove a symlink on a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		unmountAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_unmount_attempts_seconds",
+			Help:    "attempts to unmount an NFS target, by phase, before_mount or cleanup",
+			Buckets: config.LatencyBuckets,
+		}, labels("success", "phase")),
+		version: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_version",
+			Help: "NFS version negotiated with a target as listed in the mount table, always 1",
+		}, labels("version")),
+		breakerState: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_breaker_state",
+			Help: "circuit breaker state of an NFS target, 0 closed, 1 half-open, 2 open and backing off",
+		}, labels()),
+		mtimeSkew: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_file_mtime_skew_seconds",
+			Help: "mtime the NFS server set on the latest written test file minus the prober's clock",
+		}, labels()),
+		goroutineRestarts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_probe_goroutine_restarts_total",
+			Help: "probe goroutines abandoned and replaced because a probe cycle was stuck",
+		}, labels()),
+		bytesWritten: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_bytes_written_total",
+			Help: "bytes written to test files, including writes that failed part way",
+		}, labels()),
+		bytesRead: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_bytes_read_total",
+			Help: "bytes read from test files, including reads that failed part way",
+		}, labels()),
+		mountRetries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_mount_retries_total",
+			Help: "failed mounts retried within a probe, by the reason of the failure",
+		}, labels("reason")),
+		scheduleDrift: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_probe_schedule_drift_seconds",
+			Help: "how late the latest probe cycle started compared to when the interval scheduled it",
+		}, labels()),
+		dataPathStatus: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_data_path_status",
+			Help: "1 if every test file read or write of the latest probe that ran them succeeded, by path, read or write",
+		}, labels("path")),
+		dnsResolve: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_dns_resolve_seconds",
+			Help:    "lookups of the address of a hostname target before mounting",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		appendAttempts: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "nfs_append_attempts_seconds",
+			Help:    "attempts to append a record to a test file with O_APPEND and read it back on a target NFS instance",
+			Buckets: config.LatencyBuckets,
+		}, labels("success")),
+		canaryMatch: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nfs_canary_checksum_match",
+			Help: "whether the SHA-256 of the canary file matched the expected one at its latest read",
+		}, labels()),
+		sampledProbes: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "nfs_sampled_probes_total",
+			Help: "probe cycles run on the target's turn with sample_slices, once every sample_slices intervals",
+		}, labels()),
+	}
+}
+
+// registerRuntimeCollectors registers the Go runtime and process collectors, which
+// include go_goroutines and process_open_fds, unless they already are as they are on
+// prometheus.DefaultRegisterer.
+func registerRuntimeCollectors(registry prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		if err := registry.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
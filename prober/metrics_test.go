@@ -0,0 +1,76 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingRegistry keeps the collectors registered on it.
+type recordingRegistry struct {
+	*prometheus.Registry
+	collectors []prometheus.Collector
+}
+
+func (r *recordingRegistry) MustRegister(cs ...prometheus.Collector) {
+	r.Registry.MustRegister(cs...)
+	r.collectors = append(r.collectors, cs...)
+}
+
+// TestMetricsLint checks the metric names and help against the Prometheus conventions,
+// like promtool check metrics does.
+func TestMetricsLint(t *testing.T) {
+	registry := &recordingRegistry{Registry: prometheus.NewRegistry()}
+	newMetrics(Config{Registry: registry}, nil)
+	// Vectors are only exposed once they have a child, so create one in each with as
+	// many label values as it takes
+	for _, c := range registry.collectors {
+		var err error
+		for values := []string{}; len(values) < 10; values = append(values, "x") {
+			switch vec := c.(type) {
+			case *prometheus.HistogramVec:
+				_, err = vec.GetMetricWithLabelValues(values...)
+			case *prometheus.GaugeVec:
+				_, err = vec.GetMetricWithLabelValues(values...)
+			case *prometheus.CounterVec:
+				_, err = vec.GetMetricWithLabelValues(values...)
+			}
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err := testutil.GatherAndLint(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Errorf("%s: %s", problem.Metric, problem.Text)
+	}
+}
@@ -0,0 +1,235 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// mountTable is the kernel's list of mounted filesystems.
+const mountTable = "/proc/mounts"
+
+// mountEntry is a line of the mount table.
+type mountEntry struct {
+	device     string
+	mountPoint string
+	fsType     string
+	options    string
+}
+
+// readMounts parses the mount table.
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(mountTable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		entries = append(entries, mountEntry{
+			device:     unescapeMountField(fields[0]),
+			mountPoint: unescapeMountField(fields[1]),
+			fsType:     fields[2],
+			options:    fields[3],
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// unescapeMountField decodes the octal escapes the kernel uses for spaces, tabs,
+// newlines and backslashes in the mount table.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// reconcile cleans up after a previous run that didn't exit cleanly, it unmounts
+// anything still mounted under the local mount dir and removes empty directories that
+// don't belong to a configured target.
+func (p *Prober) reconcile() {
+	log := p.config.Log
+	root := filepath.Clean(p.config.LocalMountDir)
+	entries, err := readMounts()
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Warn("could not read mount table")
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.mountPoint, root+"/") {
+			continue
+		}
+		if err := syscall.Unmount(entry.mountPoint, 0); err != nil {
+			log.WithFields(logrus.Fields{"err": err, "localDir": entry.mountPoint, "device": entry.device}).Warn("could not unmount orphaned mount")
+			continue
+		}
+		log.WithFields(logrus.Fields{"localDir": entry.mountPoint, "device": entry.device}).Info("unmounted orphaned mount")
+	}
+	configured := map[string]bool{}
+	for _, n := range p.targetList() {
+		configured[n.localName] = true
+	}
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err, "localDir": root}).Warn("could not list local mount directory")
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || configured[dir.Name()] {
+			continue
+		}
+		path := filepath.Join(root, dir.Name())
+		// Remove only succeeds on empty directories, so nothing left behind on the mount is lost
+		if err := os.Remove(path); err != nil {
+			log.WithFields(logrus.Fields{"err": err, "localDir": path}).Warn("could not remove orphaned directory")
+			continue
+		}
+		log.WithFields(logrus.Fields{"localDir": path}).Info("removed orphaned directory")
+	}
+}
+
+// errNotInMountTable is returned when a mount succeeded but isn't in the mount table.
+var errNotInMountTable = errors.New("mount is not in the mount table")
+
+// onNFS checks dir exists on an NFS filesystem. The filesystem type is checked rather
+// than the mount table so dir can be anywhere under a mount, including a bind mount.
+func onNFS(dir string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return err
+	}
+	if stat.Type != unix.NFS_SUPER_MAGIC {
+		return fmt.Errorf("%s is not on an nfs mount: %w", dir, errNotInMountTable)
+	}
+	return nil
+}
+
+// checkMountTable confirms the target is in the mount table with the expected
+// filesystem type, a successful mount syscall doesn't always leave a usable mount.
+func (n *nfs) checkMountTable() error {
+	entries, err := readMounts()
+	if err != nil {
+		return fmt.Errorf("could not read mount table: %v", err)
+	}
+	for _, entry := range entries {
+		// nfs mounts with vers=4 are listed as nfs4
+		if entry.mountPoint == n.localDir() && strings.HasPrefix(entry.fsType, n.config.FSType) {
+			return nil
+		}
+	}
+	return errNotInMountTable
+}
+
+// errVersionMismatch is returned when the server negotiated another NFS version than
+// the one requested in the mount options.
+var errVersionMismatch = errors.New("negotiated nfs version doesn't match the requested version")
+
+// optionValue returns the value of the key=value option in a comma separated list.
+func optionValue(options []string, key string) string {
+	for _, option := range options {
+		if strings.HasPrefix(option, key+"=") {
+			return strings.TrimPrefix(option, key+"=")
+		}
+	}
+	return ""
+}
+
+// requestedVersion is the NFS version asked for in the mount options, eg 4.1 from
+// vers=4.1 or vers=4,minorversion=1, empty if none was.
+func (n *nfs) requestedVersion() string {
+	options, _ := parseMountOptions(n.userMountOptions())
+	version := optionValue(options, "vers")
+	if version == "" {
+		version = optionValue(options, "nfsvers")
+	}
+	if minor := optionValue(options, "minorversion"); minor != "" && version != "" && !strings.Contains(version, ".") {
+		version += "." + minor
+	}
+	return version
+}
+
+// checkVersion records the NFS version the kernel negotiated for the mount, and with
+// RequireVersion fails if it isn't the requested one.
+func (n *nfs) checkVersion(ctx context.Context) error {
+	entries, err := readMounts()
+	if err != nil {
+		return nil
+	}
+	var negotiated string
+	for _, entry := range entries {
+		if entry.mountPoint == n.localDir() {
+			negotiated = optionValue(strings.Split(entry.options, ","), "vers")
+		}
+	}
+	if negotiated == "" {
+		return nil
+	}
+	if n.config.UsePrometheus {
+		n.mu.Lock()
+		previous := n.negotiatedVersion
+		n.negotiatedVersion = negotiated
+		n.mu.Unlock()
+		if previous != "" && previous != negotiated {
+			n.metrics.version.DeleteLabelValues(n.labels(previous)...)
+		}
+		n.metrics.version.WithLabelValues(n.labels(negotiated)...).Set(1)
+	}
+	requested := n.requestedVersion()
+	if !n.config.RequireVersion || requested == "" {
+		return nil
+	}
+	// vers=4 accepts whichever minor version is negotiated
+	if negotiated == requested || strings.HasPrefix(negotiated, requested+".") {
+		return nil
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "requested": requested, "negotiated": negotiated}).Warn("nfs version mismatch")
+	return fmt.Errorf("%w: requested %s, got %s", errVersionMismatch, requested, negotiated)
+}
@@ -0,0 +1,1444 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+type nfs struct {
+	address    string
+	mountPoint string
+	// stop is closed when the target is removed by SetTargets
+	stop chan struct{}
+	// existingDir is the prober directory of an existing mount, see Prober.existingDir
+	existingDir string
+	// localName is the directory under the local mount dir the target is mounted on
+	localName string
+	target    Target
+	log       *logrus.Logger
+	config    *Config
+	metrics   *metrics
+	// rand is the Prober's source for file order and size jitter
+	rand *lockedRand
+	// writeLimiter throttles test file writes, nil when WriteRateLimit is unset
+	writeLimiter *rate.Limiter
+	// fixedTestData is the test file content shared by every write, nil unless FixedTestData
+	fixedTestData []byte
+	// slice is the turn of the target with SampleSlices, updated by SetTargets, see sampleDue
+	slice int
+	// sampleEpoch is when the Prober was created, the intervals slices take turns in
+	// are counted from it by every target
+	sampleEpoch time.Time
+	// sampleStart is the first tick of the target with SampleSlices and sampleTurn the
+	// interval it fell in
+	sampleStart time.Time
+	sampleTurn  int
+	// canaryFile is the file seeded on the export read instead of the test files, with
+	// its expected SHA-256 in hex if it's checked, see readCanary
+	canaryFile   string
+	canarySHA256 string
+	// numOfTestFiles is the number of test files of the target
+	numOfTestFiles int
+	// targetMountOptions are the target's own mount options, added after the global ones
+	targetMountOptions string
+	// ops are the operations run against the target, nil to use the global settings
+	ops map[string]bool
+	// labelValues are the values of the custom target labels, in the order of the metric labels
+	labelValues []string
+
+	// probeMu serializes Probe calls
+	probeMu sync.Mutex
+	// mu guards the in-flight mount state read by the watchdog
+	mu             sync.Mutex
+	mountStart     time.Time
+	mountGoroutine string
+	mountHung      bool
+	// negotiatedVersion is the NFS version of the latest mount
+	negotiatedVersion string
+	// circuit breaker state, see updateBreaker
+	breakerState int
+	breakerUntil time.Time
+	// resolvedAddress is the cached address of a hostname target, see resolve
+	resolvedAddress string
+	resolvedAt      time.Time
+	// appends is the number of append tests run, see appendTest
+	appends int
+	// history of the latest results, see addHistory
+	history     []Result
+	historyNext int
+	// injectCycles is how many more cycles fail with errInjected
+	injectCycles int
+	// probeStart is when the running probe cycle started, zero between cycles
+	probeStart time.Time
+	// generation of the running test goroutine, see supervise
+	generation int
+	// latest probe state, see recordResult
+	lastProbe            time.Time
+	lastSuccess          time.Time
+	lastErr              error
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	// alerting is whether the webhook was notified of a failure
+	alerting bool
+	// fileSizes are the sizes test files were last written with by index
+	fileSizes map[int]int
+	// checksums of the persisted test files by index
+	checksums map[int][sha256.Size]byte
+	// writtenAt is when the persisted test files were last written by index
+	writtenAt map[int]time.Time
+	// mounted is whether the target has been mounted successfully since starting
+	mounted bool
+	// disabled targets are skipped by test
+	disabled bool
+	// success windows of the latest probes, see updateWindows
+	mountWindow window
+	writeWindow window
+	readWindow  window
+	// cyclesSinceIO counts probe cycles since test files were last read and written
+	cyclesSinceIO int
+}
+
+// processStart is when the prober started, for nfs_time_to_first_success_seconds.
+var processStart = time.Now()
+
+// cycleIDKey is the context key of the id shared by every log entry of a probe cycle.
+type cycleIDKey struct{}
+
+// newCycleID returns a short random id for a probe cycle.
+func newCycleID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logger returns the target's logger, with the cycle id if ctx belongs to a probe cycle.
+func (n *nfs) logger(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(n.log)
+	if id, ok := ctx.Value(cycleIDKey{}).(string); ok {
+		return entry.WithField("cycle_id", id)
+	}
+	return entry
+}
+
+// labels returns the label values of a per target metric, values are the metric's own
+// labels, they are followed by the custom target labels.
+func (n *nfs) labels(values ...string) []string {
+	all := make([]string, 0, 2+len(values)+len(n.labelValues))
+	all = append(all, n.address, n.mountPoint)
+	all = append(all, values...)
+	return append(all, n.labelValues...)
+}
+
+// localDir is the local directory the target is mounted on.
+func (n *nfs) localDir() string {
+	if n.existingDir != "" {
+		return n.existingDir
+	}
+	return fmt.Sprintf("%s/%s", n.config.LocalMountDir, n.localName)
+}
+
+func (n *nfs) testFileLocation(i int) string {
+	return fmt.Sprintf("%s/%d", n.localDir(), i)
+}
+
+func (n *nfs) unmount(ctx context.Context) {
+	n.timedUnmount(ctx, 0, "cleanup")
+}
+
+// timedUnmount unmounts the target and records how long it took. Nothing mounted
+// (EINVAL) isn't recorded, it's the usual case before mounting.
+func (n *nfs) timedUnmount(ctx context.Context, flags int, phase string) error {
+	if n.config.UseExistingMount {
+		// Someone else's mount, it's never unmounted
+		return nil
+	}
+	startTime := time.Now()
+	err := syscall.Unmount(n.localDir(), flags)
+	duration := time.Since(startTime).Seconds()
+	if err == syscall.EINVAL || !n.config.UsePrometheus {
+		return err
+	}
+	success := "true"
+	if err != nil {
+		success = "false"
+	}
+	n.metrics.unmountAttempts.WithLabelValues(n.labels(success, phase)...).Observe(duration)
+	return err
+}
+
+// mountRetryDelay is the longest wait before a failed mount is retried.
+const mountRetryDelay = time.Second
+
+// retryDelay is the wait before retrying a mount, at most mountRetryDelay and half the
+// time left before ctx's deadline so the retry still has time to run. The default
+// timeout is shorter than mountRetryDelay.
+func retryDelay(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return mountRetryDelay
+	}
+	if half := time.Until(deadline) / 2; half < mountRetryDelay {
+		return half
+	}
+	return mountRetryDelay
+}
+
+// mountWithRetries mounts the target, retrying up to MountRetries times while the mount
+// fails with one of MountRetryErrnos. Other errors, like a missing export or a refused
+// permission, won't go away by retrying so they fail straight away. The duration is
+// of the last attempt.
+func (n *nfs) mountWithRetries(ctx context.Context) (time.Duration, error) {
+	for attempt := 1; ; attempt++ {
+		duration, err := n.mount(ctx)
+		err = newProbeError("mount", n.target, "", err)
+		if err == nil || attempt > n.config.MountRetries || ctx.Err() != nil {
+			return duration, err
+		}
+		reason := err.(*ProbeError).Reason
+		fields := logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "reason": reason, "errno": errnoName(err), "attempt": attempt}
+		if !n.retryable(err) {
+			n.logger(ctx).WithFields(fields).Info("not retrying mount, the error isn't transient")
+			return duration, err
+		}
+		n.logger(ctx).WithFields(fields).Info("retrying mount")
+		if n.config.UsePrometheus {
+			n.metrics.mountRetries.WithLabelValues(n.labels(reason)...).Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return duration, err
+		case <-time.After(retryDelay(ctx)):
+		}
+	}
+}
+
+// retryable is whether a mount that failed with err is worth retrying.
+func (n *nfs) retryable(err error) bool {
+	for _, errno := range n.config.MountRetryErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOptions is the option string passed to the mount syscall for a mount from
+// address, the resolved address of the target.
+func (n *nfs) mountOptions(address string) string {
+	// Already validated by New
+	options, _ := parseMountOptions("proto=" + n.config.Proto + "," + n.userMountOptions())
+	return buildMountOptions(options, address)
+}
+
+// userMountOptions are the global mount options followed by the target's own, which
+// take precedence.
+func (n *nfs) userMountOptions() string {
+	return n.config.MountOptions + "," + n.targetMountOptions
+}
+
+// proto is the transport the target is mounted over, Proto unless the mount options
+// set another.
+func (n *nfs) proto() string {
+	options, _ := parseMountOptions(n.userMountOptions())
+	for _, option := range options {
+		if strings.HasPrefix(option, "proto=") {
+			return strings.TrimPrefix(option, "proto=")
+		}
+	}
+	return n.config.Proto
+}
+
+// readOnly is whether the target is intentionally mounted read-only with ro.
+func (n *nfs) readOnly() bool {
+	options, _ := parseMountOptions(n.userMountOptions())
+	for _, option := range options {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// kerberos is whether the target is mounted with a Kerberos security flavor.
+func (n *nfs) kerberos() bool {
+	options, _ := parseMountOptions(n.userMountOptions())
+	for _, option := range options {
+		if strings.HasPrefix(option, "sec=krb5") {
+			return true
+		}
+	}
+	return false
+}
+
+// warnAttributeCache warns when the target's files are checked for the content that
+// was written, but the attribute cache is on. The client then trusts its cached
+// attributes and pages for up to acregmax, so a read can be served from the cache and
+// never reach the server.
+func (n *nfs) warnAttributeCache() {
+	if !n.verifyEnabled() && !n.config.PersistFiles && !n.config.ReadFirst {
+		return
+	}
+	// Already validated by New
+	options, _ := parseMountOptions(n.userMountOptions())
+	if n.config.UseExistingMount || attributeCacheOff(options) {
+		return
+	}
+	n.log.WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint}).Warn("attribute caching is on, reads checked for written content can be served from the client cache rather than the server, add noac to the mount options to probe the server")
+}
+
+// setupLocalDir creates the local directory the target is mounted on, a failure is a
+// problem with the prober host rather than the NFS server.
+func (n *nfs) setupLocalDir(ctx context.Context) error {
+	err := os.MkdirAll(n.localDir(), os.ModePerm)
+	if err == nil {
+		return nil
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "dir": n.localDir()}).Warn("could not create local mount directory")
+	if n.config.UsePrometheus {
+		n.metrics.localSetupFailures.WithLabelValues(n.labels()...).Inc()
+	}
+	return err
+}
+
+// clearMount unmounts anything left on the local directory before mounting, retrying
+// with a backoff while it's busy, eg right after a crashed probe, and falling back to
+// a lazy unmount so a stale mount doesn't break the new one.
+func (n *nfs) clearMount(ctx context.Context) {
+	backoff := n.config.UnmountBackoff
+	for attempt := 0; ; attempt++ {
+		err := n.timedUnmount(ctx, 0, "before_mount")
+		if err != syscall.EBUSY {
+			// Done, or nothing mounted (EINVAL) or another error a retry won't fix
+			return
+		}
+		if attempt >= n.config.UnmountRetries {
+			break
+		}
+		if n.config.UsePrometheus {
+			n.metrics.unmountRetries.WithLabelValues(n.labels("false")...).Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	err := n.timedUnmount(ctx, syscall.MNT_DETACH, "before_mount")
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "retries": n.config.UnmountRetries}).Warn("unmount still busy, detached it")
+	if n.config.UsePrometheus {
+		n.metrics.unmountRetries.WithLabelValues(n.labels("true")...).Inc()
+	}
+}
+
+// healthyMount is whether the target is still mounted from an earlier probe and its
+// prober directory can be stat'd, so it can be reused.
+func (n *nfs) healthyMount(ctx context.Context) bool {
+	if err := n.checkMountTable(); err != nil {
+		return false
+	}
+	err := withContext(ctx, func() error {
+		_, err := os.Stat(n.localDir())
+		return err
+	})
+	return err == nil
+}
+
+func (n *nfs) mount(ctx context.Context) (time.Duration, error) {
+	if n.config.UseExistingMount {
+		return 0, n.existingMount(ctx)
+	}
+	if n.config.ReuseMount && n.healthyMount(ctx) {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint}).Debug("reusing healthy mount")
+		if n.config.UsePrometheus {
+			n.metrics.status.WithLabelValues(n.labels()...).Set(1)
+		}
+		return 0, nil
+	}
+	return n.newMount(ctx)
+}
+
+// newMount mounts the target afresh, unmounting anything left on its local directory.
+func (n *nfs) newMount(ctx context.Context) (time.Duration, error) {
+	// Ensure NFS is unmounted before starting
+	n.clearMount(ctx)
+	if err := n.setupLocalDir(ctx); err != nil {
+		return 0, err
+	}
+	// Resolved before timing the mount, a failed lookup is reported as a failed mount
+	address, err := n.resolve(ctx)
+	// Start Time to be used for all duration logs
+	startTime := time.Now()
+	n.mu.Lock()
+	n.mountStart = startTime
+	n.mountGoroutine = goroutineID()
+	n.mu.Unlock()
+	if err == nil {
+		// Use syscall to mount the NFS directory
+		err = syscall.Mount(fmt.Sprintf(":%s", n.mountPoint), n.localDir(), n.config.FSType, 0, n.mountOptions(address))
+	}
+	if err == nil && n.config.VerifyMountTable {
+		err = n.checkMountTable()
+	}
+	if err == nil {
+		err = n.checkVersion(ctx)
+	}
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	n.mu.Lock()
+	n.mountStart = time.Time{}
+	wasHung := n.mountHung
+	n.mountHung = false
+	n.mu.Unlock()
+	if wasHung {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "duration": duration}).Warn("hung mount returned")
+		if n.config.UsePrometheus {
+			n.metrics.mountHung.WithLabelValues(n.labels()...).Set(0)
+		}
+	}
+	if err != nil {
+		probeErr := newProbeError("mount", n.target, "", err).(*ProbeError)
+		if probeErr.Reason == "permission_denied" && n.kerberos() {
+			// With sec=krb5* the server answers EACCES when the GSS context can't be
+			// established, which is almost always a credential problem on this host
+			probeErr.Reason = "auth"
+		}
+		err = probeErr
+		n.statusDown()
+		if n.config.UsePrometheus {
+			n.metrics.mountAttempts.WithLabelValues(n.labels("false", n.proto())...).Observe(duration)
+			n.metrics.mountErrors.WithLabelValues(n.labels(probeErr.Reason)...).Inc()
+		}
+		if n.config.KeepMountOnTimeout && isTimeout(ctx, err) {
+			n.keepDiagnosticMount(ctx, err)
+			return elapsed, err
+		}
+		n.unmount(ctx)
+		return elapsed, err
+	}
+	if n.config.MaxMountDuration > 0 && duration > n.config.MaxMountDuration.Seconds() {
+		// Still a successful mount, but too slow for latency sensitive workloads
+		n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "maxDuration": n.config.MaxMountDuration.Seconds()}).Warn("mount successful but slow")
+		if n.config.UsePrometheus {
+			n.metrics.mountSlow.WithLabelValues(n.labels()...).Inc()
+		}
+	} else if !n.config.QuietMounts {
+		n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration}).Info("mount successful")
+	}
+	if n.config.UsePrometheus {
+		n.metrics.status.WithLabelValues(n.labels()...).Set(1)
+		n.metrics.mountAttempts.WithLabelValues(n.labels("true", n.proto())...).Observe(duration)
+	}
+	n.mu.Lock()
+	first := !n.mounted
+	n.mounted = true
+	n.mu.Unlock()
+	if first {
+		sinceStart := time.Since(processStart).Seconds()
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "sinceStart": sinceStart}).Info("first successful mount")
+		if n.config.UsePrometheus {
+			n.metrics.timeToFirstSuccess.WithLabelValues(n.labels()...).Set(sinceStart)
+		}
+	}
+	return elapsed, nil
+}
+
+// existingMount checks the prober directory of a target that is already mounted, eg a
+// bind mount shared with the host, exists and is on NFS. It isn't created, a missing
+// bind mount would otherwise have the probe write to the local disk and pass. A
+// failure fails the probe like a failed mount but isn't recorded as a mount attempt.
+func (n *nfs) existingMount(ctx context.Context) error {
+	err := withContext(ctx, func() error {
+		return onNFS(n.localDir())
+	})
+	if err != nil {
+		n.statusDown()
+		return newProbeError("mount", n.target, "", err)
+	}
+	if n.config.UsePrometheus {
+		n.metrics.status.WithLabelValues(n.labels()...).Set(1)
+	}
+	n.mu.Lock()
+	first := !n.mounted
+	n.mounted = true
+	n.mu.Unlock()
+	if first {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "dir": n.localDir()}).Info("probing existing mount")
+	}
+	return nil
+}
+
+// readTestFiles reads the test files with the given indices, returning one result per index.
+func (n *nfs) readTestFiles(ctx context.Context, indices []int) []FileResult {
+	var results []FileResult
+	for k, i := range indices {
+		if n.failedFast(ctx, "read", results, len(indices)-k) {
+			break
+		}
+		i := i
+		testFileLocation := n.testFileLocation(i)
+		startTime := time.Now()
+		err := withContext(ctx, func() error {
+			return n.asTestIdentity(func() error {
+				return n.readTestFile(i, testFileLocation)
+			})
+		})
+		elapsed := time.Since(startTime)
+		duration := elapsed.Seconds()
+		if err != nil {
+			if n.config.UsePrometheus {
+				n.metrics.readAttempts.WithLabelValues(n.labels(testFileLocation, "false", n.proto())...).Observe(duration)
+			}
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: newProbeError("read", n.target, testFileLocation, err)})
+			continue
+		}
+		if !n.config.QuietReads {
+			n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": testFileLocation}).Info("read test file")
+		}
+		if n.config.UsePrometheus {
+			n.metrics.readAttempts.WithLabelValues(n.labels(testFileLocation, "true", n.proto())...).Observe(duration)
+		}
+		results = append(results, FileResult{File: testFileLocation, Duration: elapsed})
+	}
+	return results
+}
+
+// failedFast is whether a read or write loop stops before its next test file with
+// FailFastIO because one in results failed, the rest of the files aren't tried.
+func (n *nfs) failedFast(ctx context.Context, op string, results []FileResult, skipped int) bool {
+	if !n.config.FailFastIO || allSucceeded(results) {
+		return false
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "file": results[len(results)-1].File, "skipped": skipped}).Warn("stopping test file " + op + "s at the first failure")
+	return true
+}
+
+// fileIndices returns the indices of the test files read and written each cycle, in a
+// new random order each call with RandomFileOrder.
+func (n *nfs) fileIndices() []int {
+	indices := make([]int, n.numOfTestFiles)
+	for i := range indices {
+		indices[i] = i
+	}
+	if n.config.RandomFileOrder {
+		n.rand.Shuffle(len(indices), func(i, j int) {
+			indices[i], indices[j] = indices[j], indices[i]
+		})
+	}
+	return indices
+}
+
+// persistedTestFiles only writes test files that haven't been written by this process
+// yet, then reads every file back and checks it still has the written content. Files
+// that fail are rewritten, so data is checked across cycles instead of straight after
+// it was written. Files older than MaxFileAge are rewritten after they pass, so the
+// write path is still exercised, at a slower cadence than reads. With ReadFirst the
+// unwritten files are only written after the others are verified.
+func (n *nfs) persistedTestFiles(ctx context.Context, result *Result) {
+	indices, unwritten := n.writtenIndices()
+	if !n.config.ReadFirst {
+		result.Writes = n.writeTestFiles(ctx, unwritten)
+		if n.config.FailFastIO && !allSucceeded(result.Writes) {
+			return
+		}
+		if n.opEnabled("chmod") {
+			result.Chmods = n.chmodTestFiles(ctx, result.Writes)
+		}
+		indices, unwritten = n.fileIndices(), nil
+	}
+	result.Reads = n.readTestFiles(ctx, indices)
+	if n.config.FailFastIO && !allSucceeded(result.Reads) {
+		return
+	}
+	if len(unwritten) > 0 {
+		result.Writes = n.writeTestFiles(ctx, unwritten)
+		if n.opEnabled("chmod") {
+			result.Chmods = n.chmodTestFiles(ctx, result.Writes)
+		}
+	}
+	var failed, expired []int
+	for k, read := range result.Reads {
+		if read.Err != nil {
+			failed = append(failed, indices[k])
+		} else if n.expired(indices[k]) {
+			expired = append(expired, indices[k])
+		}
+	}
+	if len(failed) > 0 {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "files": failed}).Warn("regenerating test files that failed verification")
+		result.Writes = append(result.Writes, n.writeTestFiles(ctx, failed)...)
+	}
+	if len(expired) > 0 {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "files": expired}).Info("rewriting test files older than max file age")
+		result.Writes = append(result.Writes, n.writeTestFiles(ctx, expired)...)
+	}
+}
+
+// writtenIndices splits the test file indices into the files written by this process,
+// whose checksum is known, and the ones that aren't yet.
+func (n *nfs) writtenIndices() (written []int, unwritten []int) {
+	for _, i := range n.fileIndices() {
+		if _, ok := n.checksum(i); ok {
+			written = append(written, i)
+		} else {
+			unwritten = append(unwritten, i)
+		}
+	}
+	return written, unwritten
+}
+
+// newFileSize returns the size of a test file about to be written, TestFileSize
+// randomized by up to FileSizeJitter percent either way.
+func (n *nfs) newFileSize() int {
+	jitter := n.config.TestFileSize * n.config.FileSizeJitter / 100
+	if jitter == 0 {
+		return n.config.TestFileSize
+	}
+	return n.config.TestFileSize - jitter + n.rand.Intn(2*jitter+1)
+}
+
+// testData returns size bytes of test file content, new random bytes unless
+// FixedTestData reuses the ones drawn at startup.
+func (n *nfs) testData(size int) ([]byte, error) {
+	if size <= len(n.fixedTestData) {
+		return n.fixedTestData[:size], nil
+	}
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// fileSize returns the size test file i was last written with.
+func (n *nfs) fileSize(i int) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if size, ok := n.fileSizes[i]; ok {
+		return size
+	}
+	return n.config.TestFileSize
+}
+
+func (n *nfs) setFileSize(i int, size int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.fileSizes == nil {
+		n.fileSizes = map[int]int{}
+	}
+	n.fileSizes[i] = size
+}
+
+func (n *nfs) checksum(i int) ([sha256.Size]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	checksum, ok := n.checksums[i]
+	return checksum, ok
+}
+
+func (n *nfs) setChecksum(i int, checksum [sha256.Size]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.checksums == nil {
+		n.checksums = map[int][sha256.Size]byte{}
+	}
+	n.checksums[i] = checksum
+	if n.writtenAt == nil {
+		n.writtenAt = map[int]time.Time{}
+	}
+	n.writtenAt[i] = time.Now()
+}
+
+// expired is whether persisted test file i was written longer than MaxFileAge ago.
+func (n *nfs) expired(i int) bool {
+	if n.config.MaxFileAge <= 0 {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	writtenAt, ok := n.writtenAt[i]
+	return ok && time.Since(writtenAt) > n.config.MaxFileAge
+}
+
+// readTestFile streams a test file and makes sure exactly the expected number of bytes
+// come back, a flaky mount can return a short read without an error.
+func (n *nfs) readTestFile(i int, testFileLocation string) error {
+	f, err := os.Open(testFileLocation)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size := n.fileSize(i)
+	b := make([]byte, size)
+	read, err := io.ReadFull(f, b)
+	n.countRead(read)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("truncated read, got %d bytes from file, but expected %d bytes", read, size)
+	}
+	if err != nil {
+		return err
+	}
+	// Anything past the expected size means the file isn't the one that was written
+	extra, _ := f.Read(make([]byte, 1))
+	n.countRead(extra)
+	if extra > 0 {
+		return fmt.Errorf("got more bytes from file than the expected %d bytes", size)
+	}
+	if n.config.PersistFiles || n.config.ReadFirst {
+		checksum, ok := n.checksum(i)
+		if !ok {
+			return errors.New("no checksum recorded for file")
+		}
+		if sha256.Sum256(b) != checksum {
+			return errors.New("file content doesn't match what was written")
+		}
+	}
+	return nil
+}
+
+// statProberDir times a stat of the mounted prober directory, a cheap way to exercise
+// the server without reading or writing files.
+func (n *nfs) statProberDir(ctx context.Context) *FileResult {
+	startTime := time.Now()
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			_, err := os.Stat(n.localDir())
+			return err
+		})
+	})
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration}).Warn("could not stat prober directory")
+		if n.config.UsePrometheus {
+			n.metrics.statAttempts.WithLabelValues(n.labels("false")...).Observe(duration)
+		}
+		return &FileResult{File: n.localDir(), Duration: elapsed, Err: err}
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration}).Info("stat prober directory")
+	if n.config.UsePrometheus {
+		n.metrics.statAttempts.WithLabelValues(n.labels("true")...).Observe(duration)
+	}
+	return &FileResult{File: n.localDir(), Duration: elapsed}
+}
+
+// removeStaleTestFiles deletes test files left over from a larger num_of_files or a
+// target's num_files before a reload.
+// Only regular files named by an index are touched so nothing else in the prober directory is removed.
+func (n *nfs) removeStaleTestFiles(ctx context.Context) {
+	dir := n.localDir()
+	var entries []os.FileInfo
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			var err error
+			entries, err = ioutil.ReadDir(dir)
+			return err
+		})
+	})
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err}).Warn("could not list test files")
+		return
+	}
+	for _, entry := range entries {
+		i, ok := testFileIndex(entry)
+		if !ok || i < n.numOfTestFiles {
+			continue
+		}
+		testFileLocation := fmt.Sprintf("%s/%d", dir, i)
+		err = withContext(ctx, func() error {
+			return n.asTestIdentity(func() error {
+				return os.Remove(testFileLocation)
+			})
+		})
+		if err != nil && !os.IsNotExist(err) {
+			n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "file": testFileLocation}).Warn("could not remove stale test file")
+			continue
+		}
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "file": testFileLocation}).Info("removed stale test file")
+	}
+}
+
+// testFileIndex is the index of a test file in the prober directory, ok is false for
+// anything that isn't a regular file named by an index.
+func testFileIndex(entry os.FileInfo) (int, bool) {
+	i, err := strconv.Atoi(entry.Name())
+	return i, err == nil && strconv.Itoa(i) == entry.Name() && entry.Mode().IsRegular()
+}
+
+// countTestFiles reports how many test files, regular files named by an index, are in
+// the prober directory, to be compared against num_of_files to catch stale files or
+// external interference. The prober's other files, eg the append test file, aren't
+// counted.
+func (n *nfs) countTestFiles(ctx context.Context) {
+	var entries []os.FileInfo
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			var err error
+			entries, err = ioutil.ReadDir(n.localDir())
+			return err
+		})
+	})
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err}).Warn("could not list test files")
+		return
+	}
+	count := 0
+	for _, entry := range entries {
+		if _, ok := testFileIndex(entry); ok {
+			count++
+		}
+	}
+	if n.config.UsePrometheus {
+		n.metrics.testFilesPresent.WithLabelValues(n.labels()...).Set(float64(count))
+	}
+}
+
+// writeTestFiles writes the test files with the given indices, returning one result per index.
+func (n *nfs) writeTestFiles(ctx context.Context, indices []int) []FileResult {
+	var results []FileResult
+	n.removeStaleTestFiles(ctx)
+	for k, i := range indices {
+		if n.failedFast(ctx, "write", results, len(indices)-k) {
+			break
+		}
+		testFileLocation := n.testFileLocation(i)
+		size := n.newFileSize()
+		b, err := n.testData(size)
+		if err != nil {
+			results = append(results, FileResult{File: testFileLocation, Err: newProbeError("write", n.target, testFileLocation, err)})
+			continue
+		}
+		// Recorded before writing so a partly written file fails its read
+		n.setFileSize(i, size)
+		startTime := time.Now()
+		err = withContext(ctx, func() error {
+			return n.asTestIdentity(func() error {
+				return n.writeTestFile(ctx, testFileLocation, b)
+			})
+		})
+		elapsed := time.Since(startTime)
+		duration := elapsed.Seconds()
+		// make sure the number of bytes read matches the file size
+		if err == nil && len(b) != size {
+			err = fmt.Errorf("got %d bytes from file, but expected %d bytes", len(b), size)
+		}
+		if err != nil {
+			if n.config.UsePrometheus {
+				n.metrics.writeAttempts.WithLabelValues(n.labels(testFileLocation, "false", n.proto())...).Observe(duration)
+			}
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: newProbeError("write", n.target, testFileLocation, err)})
+			continue
+		}
+		if !n.config.QuietWrites {
+			n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": testFileLocation}).Info("write test file")
+		}
+		if n.config.UsePrometheus {
+			n.metrics.writeAttempts.WithLabelValues(n.labels(testFileLocation, "true", n.proto())...).Observe(duration)
+		}
+		results = append(results, FileResult{File: testFileLocation, Duration: elapsed})
+		if n.config.PersistFiles || n.config.ReadFirst {
+			n.setChecksum(i, sha256.Sum256(b))
+		}
+		n.checkFileMode(ctx, testFileLocation)
+	}
+	return results
+}
+
+// writeTestFile writes b to a test file, streamed in chunks of at most WriteRateLimit
+// bytes per second when that is set so the probe is gentle on shared storage.
+func (n *nfs) writeTestFile(ctx context.Context, testFileLocation string, b []byte) error {
+	f, err := os.OpenFile(testFileLocation, os.O_WRONLY|os.O_CREATE|os.O_EXCL, n.config.TestFileMode)
+	created := err == nil
+	if os.IsExist(err) {
+		f, err = os.OpenFile(testFileLocation, os.O_WRONLY|os.O_TRUNC, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if created {
+		// The mode given to OpenFile is masked by the umask. A failure isn't a failed
+		// write, checkFileMode reports the mode the file ended up with
+		f.Chmod(n.config.TestFileMode)
+	}
+	for len(b) > 0 {
+		chunk := len(b)
+		if n.writeLimiter != nil {
+			if burst := n.writeLimiter.Burst(); chunk > burst {
+				chunk = burst
+			}
+			if err := n.writeLimiter.WaitN(ctx, chunk); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		written, err := f.Write(b[:chunk])
+		n.countWritten(written)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		b = b[chunk:]
+	}
+	return f.Close()
+}
+
+// countWritten and countRead add bytes actually moved to or from a test file to
+// nfs_bytes_written_total and nfs_bytes_read_total.
+func (n *nfs) countWritten(written int) {
+	if n.config.UsePrometheus {
+		n.metrics.bytesWritten.WithLabelValues(n.labels()...).Add(float64(written))
+	}
+}
+
+func (n *nfs) countRead(read int) {
+	if n.config.UsePrometheus {
+		n.metrics.bytesRead.WithLabelValues(n.labels()...).Add(float64(read))
+	}
+}
+
+// checkFileMode compares the mode of a written test file with the requested mode,
+// root-squash and ACLs on the export can silently change it. It also checks the mtime
+// set by the server.
+func (n *nfs) checkFileMode(ctx context.Context, testFileLocation string) {
+	var info os.FileInfo
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			var err error
+			info, err = os.Stat(testFileLocation)
+			return err
+		})
+	})
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "file": testFileLocation}).Warn("could not stat test file")
+		return
+	}
+	n.checkMtimeSkew(ctx, testFileLocation, info.ModTime())
+	if info.Mode().Perm() != n.config.TestFileMode.Perm() {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "file": testFileLocation, "mode": fmt.Sprintf("%#o", info.Mode().Perm()), "expectedMode": fmt.Sprintf("%#o", n.config.TestFileMode.Perm())}).Warn("test file mode does not match")
+		if n.config.UsePrometheus {
+			n.metrics.fileModeMatch.WithLabelValues(n.labels(testFileLocation)...).Set(0)
+		}
+		return
+	}
+	if n.config.UsePrometheus {
+		n.metrics.fileModeMatch.WithLabelValues(n.labels(testFileLocation)...).Set(1)
+	}
+}
+
+// checkMtimeSkew compares the mtime the server set on a just written test file with
+// the local clock, a server clock far off breaks applications relying on timestamps.
+// A small skew is normal, only one past MtimeSkewThreshold is logged.
+func (n *nfs) checkMtimeSkew(ctx context.Context, testFileLocation string, mtime time.Time) {
+	skew := mtime.Sub(time.Now())
+	if n.config.UsePrometheus {
+		n.metrics.mtimeSkew.WithLabelValues(n.labels()...).Set(skew.Seconds())
+	}
+	if n.config.MtimeSkewThreshold > 0 && (skew > n.config.MtimeSkewThreshold || -skew > n.config.MtimeSkewThreshold) {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "file": testFileLocation, "skew": skew.Seconds(), "threshold": n.config.MtimeSkewThreshold.Seconds()}).Warn("test file mtime skewed from local clock")
+	}
+}
+
+// chmodTestFiles changes the mode of the test files in writes that were written
+// successfully and stats them back, files that weren't written aren't chmodded.
+func (n *nfs) chmodTestFiles(ctx context.Context, writes []FileResult) []FileResult {
+	var results []FileResult
+	// Flip the group read bit so the new mode always differs from the written one
+	chmodMode := n.config.TestFileMode ^ 0040
+	for _, write := range writes {
+		if write.Err != nil {
+			continue
+		}
+		testFileLocation := write.File
+		startTime := time.Now()
+		var info os.FileInfo
+		err := withContext(ctx, func() error {
+			return n.asTestIdentity(func() error {
+				if err := os.Chmod(testFileLocation, chmodMode); err != nil {
+					return err
+				}
+				stat, err := os.Stat(testFileLocation)
+				// Restore the requested mode so the next write sees the expected permissions
+				os.Chmod(testFileLocation, n.config.TestFileMode)
+				info = stat
+				return err
+			})
+		})
+		elapsed := time.Since(startTime)
+		duration := elapsed.Seconds()
+		if errors.Is(err, syscall.EPERM) {
+			// root-squashed exports refuse metadata changes, which is expected rather than broken
+			n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": testFileLocation}).Warn("chmod not permitted on test file, export may be root-squashed")
+			if n.config.UsePrometheus {
+				n.metrics.chmodAttempts.WithLabelValues(n.labels(testFileLocation, "eperm")...).Observe(duration)
+			}
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: err})
+			continue
+		}
+		if err != nil {
+			n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": testFileLocation}).Warn("could not chmod test file")
+			if n.config.UsePrometheus {
+				n.metrics.chmodAttempts.WithLabelValues(n.labels(testFileLocation, "false")...).Observe(duration)
+			}
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: err})
+			continue
+		}
+		if info.Mode().Perm() != chmodMode.Perm() {
+			err = fmt.Errorf("got mode %#o after chmod, but expected %#o", info.Mode().Perm(), chmodMode.Perm())
+			n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": testFileLocation}).Warn("could not chmod test file")
+			if n.config.UsePrometheus {
+				n.metrics.chmodAttempts.WithLabelValues(n.labels(testFileLocation, "false")...).Observe(duration)
+			}
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: err})
+			continue
+		}
+		n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": testFileLocation}).Info("chmod test file")
+		if n.config.UsePrometheus {
+			n.metrics.chmodAttempts.WithLabelValues(n.labels(testFileLocation, "true")...).Observe(duration)
+		}
+		results = append(results, FileResult{File: testFileLocation, Duration: elapsed})
+	}
+	return results
+}
+
+func (n *nfs) isDisabled() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.disabled
+}
+
+func (n *nfs) setDisabled(disabled bool) {
+	n.mu.Lock()
+	n.disabled = disabled
+	n.mu.Unlock()
+	if n.config.UsePrometheus {
+		value := 0.0
+		if disabled {
+			value = 1
+		}
+		n.metrics.targetDisabled.WithLabelValues(n.labels()...).Set(value)
+	}
+}
+
+func (n *nfs) test(ctx context.Context, generation int) {
+	ticker := time.NewTicker(n.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case scheduled := <-ticker.C:
+			if n.isDisabled() || !n.sampleDue(scheduled) || !n.breakerAllows() {
+				continue
+			}
+			if n.config.SampleSlices > 1 && n.config.UsePrometheus {
+				n.metrics.sampledProbes.WithLabelValues(n.labels()...).Inc()
+			}
+			// A cycle taking longer than the interval leaves the next tick waiting
+			if n.config.UsePrometheus {
+				n.metrics.scheduleDrift.WithLabelValues(n.labels()...).Set(time.Since(scheduled).Seconds())
+			}
+			n.probe(ctx)
+			// A goroutine replaced while it was stuck stops once its cycle returns
+			n.mu.Lock()
+			replaced := n.generation != generation
+			n.mu.Unlock()
+			if replaced {
+				return
+			}
+		}
+	}
+}
+
+// sampleDue is whether the target is probed on the tick scheduled at scheduled. With
+// SampleSlices the targets are split into that many slices which take turns, one slice
+// each interval, so every target is probed once every SampleSlices intervals. The
+// intervals are counted from the Prober's epoch, so targets added later take their
+// turns in step with the others.
+func (n *nfs) sampleDue(scheduled time.Time) bool {
+	if n.config.SampleSlices <= 1 {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sampleStart.IsZero() {
+		n.sampleStart = scheduled
+		n.sampleTurn = int(scheduled.Sub(n.sampleEpoch) / n.config.Interval)
+	}
+	// Counted from the target's own first tick, which the ticker keeps whole intervals
+	// apart, so a late tick can't land in the next interval
+	elapsed := math.Round(float64(scheduled.Sub(n.sampleStart)) / float64(n.config.Interval))
+	return (n.sampleTurn+int(elapsed))%n.config.SampleSlices == n.slice
+}
+
+func (n *nfs) setSlice(slice int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.slice = slice
+}
+
+// supervise runs test and starts a new one when a probe cycle has run for longer than
+// RestartHungAfter intervals. A syscall can't be interrupted, so the stuck goroutine is
+// abandoned, it exits if its cycle ever returns.
+func (n *nfs) supervise(ctx context.Context) {
+	go n.test(ctx, 0)
+	limit := time.Duration(n.config.RestartHungAfter) * n.config.Interval
+	ticker := time.NewTicker(n.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			started := n.probeStart
+			stuck := !started.IsZero() && time.Since(started) > limit
+			if stuck {
+				n.generation++
+				// The stuck cycle no longer counts as in flight, the new goroutine's will
+				n.probeStart = time.Time{}
+			}
+			generation := n.generation
+			n.mu.Unlock()
+			if !stuck {
+				continue
+			}
+			n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "blocked": time.Since(started).Seconds()}).Error("probe cycle is stuck, starting a new probe goroutine")
+			if n.config.UsePrometheus {
+				n.metrics.goroutineRestarts.WithLabelValues(n.labels()...).Inc()
+			}
+			go n.test(ctx, generation)
+		}
+	}
+}
+
+// probe runs a single probe cycle against the target and records its result.
+func (n *nfs) probe(ctx context.Context) Result {
+	result := n.cycle(ctx)
+	result.End = time.Now()
+	wrapErrors(&result)
+	// So everything logged about the result has the cycle id
+	ctx = context.WithValue(ctx, cycleIDKey{}, result.CycleID)
+	n.recordResult(ctx, result)
+	n.updateBreaker(ctx, result)
+	n.updateAlert(ctx, result)
+	n.writeResult(ctx, result)
+	if n.config.OnResult != nil {
+		n.config.OnResult(result)
+	}
+	return result
+}
+
+func (n *nfs) cycle(ctx context.Context) Result {
+	result := Result{Target: n.target, CycleID: newCycleID(), Start: time.Now()}
+	n.mu.Lock()
+	n.probeStart = result.Start
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		// Unless supervise has already given up on this cycle
+		if n.probeStart.Equal(result.Start) {
+			n.probeStart = time.Time{}
+		}
+		n.mu.Unlock()
+	}()
+	ctx = context.WithValue(ctx, cycleIDKey{}, result.CycleID)
+	if n.config.UsePrometheus {
+		n.metrics.probeInProgress.WithLabelValues(n.labels()...).Set(1)
+		defer n.metrics.probeInProgress.WithLabelValues(n.labels()...).Set(0)
+	}
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, n.config.Timeout)
+	defer cancel()
+	if result.MountErr = n.injectedFailure(ctx); result.MountErr != nil {
+		return result
+	}
+	if n.config.ReachabilityCheck {
+		n.checkReachable(ctxWithTimeout)
+	}
+	result.MountDuration, result.MountErr = n.mountWithRetries(ctxWithTimeout)
+	if result.MountErr != nil {
+		return result
+	}
+	if n.opEnabled("stat") {
+		result.Stat = n.statProberDir(ctxWithTimeout)
+	}
+	if n.opEnabled("dir") {
+		result.Dirs = n.dirTest(ctxWithTimeout, result.CycleID)
+	}
+	if n.opEnabled("symlink") {
+		result.Symlink = n.symlinkTest(ctxWithTimeout)
+	}
+	if n.opEnabled("append") {
+		result.Append = n.appendTest(ctxWithTimeout)
+	}
+	if (n.opEnabled("read") || n.opEnabled("write") || n.canaryFile != "") && n.ioDue() {
+		ioCtx, ioCancel := context.WithTimeout(ctx, n.config.IOTimeout)
+		defer ioCancel()
+		n.testFiles(ctx, ioCtx, &result)
+		if staleHandle(result) && n.remountStale(ioCtx) {
+			// Only retried once, a handle that is stale again is reported as a failure
+			result.Writes, result.Chmods, result.Reads = nil, nil, nil
+			n.testFiles(ctx, ioCtx, &result)
+		}
+		if n.verifyEnabled() {
+			result.Verifies = n.verifyTestFiles(ioCtx)
+		}
+		if n.opEnabled("write") && !n.readOnly() && n.canaryFile == "" {
+			n.countTestFiles(ioCtx)
+		}
+		if n.config.KeepMountOnTimeout && isTimeout(ioCtx, nil) {
+			n.statusDown()
+			n.keepDiagnosticMount(ctx, ioCtx.Err())
+		}
+	}
+	return result
+}
+
+// testFiles writes, chmods and reads the test files, or only reads the canary file.
+func (n *nfs) testFiles(ctx context.Context, ioCtx context.Context, result *Result) {
+	if n.canaryFile != "" {
+		result.Reads = []FileResult{n.readCanary(ioCtx)}
+		return
+	}
+	if n.config.UsePrometheus {
+		skipped := 0.0
+		if n.readOnly() {
+			skipped = 1
+		}
+		n.metrics.writesSkipped.WithLabelValues(n.labels()...).Set(skipped)
+	}
+	if n.readOnly() || !n.opEnabled("write") {
+		// Writes can only fail with EROFS on a read-only mount, so just read the
+		// pre-seeded files
+		result.Reads = n.readTestFiles(ioCtx, n.fileIndices())
+		return
+	}
+	if n.config.PersistFiles && n.opEnabled("read") {
+		n.persistedTestFiles(ioCtx, result)
+		return
+	}
+	if n.config.ReadFirst && n.opEnabled("read") {
+		// Verifies the files written by the previous cycle before they're replaced
+		written, _ := n.writtenIndices()
+		result.Reads = n.readTestFiles(ioCtx, written)
+		if n.config.FailFastIO && !allSucceeded(result.Reads) {
+			return
+		}
+		result.Writes = n.writeTestFiles(ioCtx, n.fileIndices())
+		if n.opEnabled("chmod") {
+			result.Chmods = n.chmodTestFiles(ioCtx, result.Writes)
+		}
+		return
+	}
+	result.Writes = n.writeTestFiles(ioCtx, n.fileIndices())
+	if n.config.FailFastIO && !allSucceeded(result.Writes) {
+		return
+	}
+	if n.opEnabled("chmod") {
+		result.Chmods = n.chmodTestFiles(ioCtx, result.Writes)
+	}
+	if n.opEnabled("read") {
+		result.Reads = n.readTestFiles(ioCtx, n.fileIndices())
+	}
+}
+
+// verifyEnabled is whether verify rounds run against the target, they write so they
+// only run where writes do, never in canary mode.
+func (n *nfs) verifyEnabled() bool {
+	return n.config.VerifyRounds > 0 && n.opEnabled("write") && !n.readOnly() && n.canaryFile == ""
+}
+
+// opEnabled is whether op runs against the target, its ops from the config file when
+// it has them, otherwise the global settings.
+func (n *nfs) opEnabled(op string) bool {
+	if n.ops != nil {
+		return n.ops[op]
+	}
+	switch op {
+	case "stat":
+		return n.config.StatTest
+	case "dir":
+		return n.config.DirTest
+	case "symlink":
+		return n.config.SymlinkTest
+	case "append":
+		return n.config.AppendTest
+	case "write", "read":
+		return n.config.ReadWrite
+	case "chmod":
+		return n.config.ReadWrite && n.config.ChmodTest
+	}
+	return false
+}
+
+// staleHandle is whether any test file operation in result failed with ESTALE.
+func staleHandle(result Result) bool {
+	for _, results := range [][]FileResult{result.Writes, result.Chmods, result.Reads} {
+		for _, r := range results {
+			if errors.Is(r.Err, syscall.ESTALE) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remountStale remounts the target after a stale file handle, common after the
+// server restarts, and returns whether the remount succeeded. The mount is replaced
+// even with ReuseMount, a stale mount still passes the reuse check.
+func (n *nfs) remountStale(ctx context.Context) bool {
+	if n.config.UseExistingMount {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint}).Warn("stale file handle on an existing mount, it can't be remounted by the prober")
+		return false
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint}).Warn("stale file handle, remounting")
+	if _, err := n.newMount(ctx); err != nil {
+		return false
+	}
+	if n.config.UsePrometheus {
+		n.metrics.staleHandleRecoveries.WithLabelValues(n.labels()...).Inc()
+	}
+	return true
+}
+
+// checkReachable dials the NFS port of the server before mounting, so an unreachable
+// server can be told apart from a problem with the export.
+func (n *nfs) checkReachable(ctx context.Context) {
+	address := net.JoinHostPort(n.address, strconv.Itoa(n.config.NFSPort))
+	startTime := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	duration := time.Since(startTime).Seconds()
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration}).Warn("nfs server unreachable")
+		if n.config.UsePrometheus {
+			n.metrics.serverReachable.WithLabelValues(n.address).Set(0)
+		}
+		return
+	}
+	conn.Close()
+	n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration}).Info("nfs server reachable")
+	if n.config.UsePrometheus {
+		n.metrics.serverReachable.WithLabelValues(n.address).Set(1)
+	}
+}
+
+// ioDue reports whether this cycle should read and write test files, which happens on
+// the first cycle and then every RWInterval.
+func (n *nfs) ioDue() bool {
+	every := int((n.config.RWInterval + n.config.Interval/2) / n.config.Interval)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	due := n.cyclesSinceIO == 0
+	n.cyclesSinceIO++
+	if n.cyclesSinceIO >= every {
+		n.cyclesSinceIO = 0
+	}
+	return due
+}
+
+// keepDiagnosticMount warns that a timed out mount was left in place, it's cleaned up
+// by the unmount before the next mount.
+func (n *nfs) keepDiagnosticMount(ctx context.Context, err error) {
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "localDir": n.localDir()}).Warn("probe timed out, RETAINING DIAGNOSTIC MOUNT until the next probe")
+}
+
+// isTimeout reports whether err or ctx show the probe ran out of time.
+func isTimeout(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) || ctx.Err() == context.DeadlineExceeded
+}
+
+// watchdog reports mount syscalls that have blocked longer than the hang threshold.
+// The syscall can't be interrupted, so the best it can do is make the hang visible.
+func (n *nfs) watchdog(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			started, id, hung := n.mountStart, n.mountGoroutine, n.mountHung
+			if !started.IsZero() && !hung && time.Since(started) > n.config.HangThreshold {
+				n.mountHung = true
+			}
+			n.mu.Unlock()
+			if started.IsZero() || hung || time.Since(started) <= n.config.HangThreshold {
+				continue
+			}
+			n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "blocked": time.Since(started).Seconds(), "stack": goroutineStack(id)}).Error("mount syscall is hung")
+			if n.config.UsePrometheus {
+				n.metrics.mountHung.WithLabelValues(n.labels()...).Set(1)
+			}
+		}
+	}
+}
+
+// goroutineID returns the id of the calling goroutine from its stack header.
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// The header is in the form "goroutine 123 [running]:"
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// goroutineStack returns the stack trace of the goroutine with the given id.
+func goroutineStack(id string) string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.HasPrefix(stack, fmt.Sprintf("goroutine %s ", id)) {
+			return stack
+		}
+	}
+	return ""
+}
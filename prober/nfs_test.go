@@ -0,0 +1,144 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sampleCount is the number of observations of the histogram name in registry.
+func sampleCount(t *testing.T, registry *prometheus.Registry, name string) uint64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			count += metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return count
+}
+
+func TestMountWithRetries(t *testing.T) {
+	// An unknown filesystem type fails every mount straight away, with ENODEV as root
+	// and EPERM otherwise
+	failing := []syscall.Errno{syscall.ENODEV, syscall.EPERM}
+	tests := []struct {
+		name         string
+		retries      int
+		errnos       []syscall.Errno
+		wantAttempts uint64
+	}{
+		{name: "retried within the default timeout", retries: 2, errnos: failing, wantAttempts: 3},
+		{name: "no retries", retries: 0, errnos: failing, wantAttempts: 1},
+		{name: "not a transient errno", retries: 2, errnos: []syscall.Errno{syscall.ETIMEDOUT}, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			p, cleanup := newTestProber(t, Config{
+				Timeout:          250 * time.Millisecond,
+				FSType:           "nfs-prober-test",
+				MountRetries:     tt.retries,
+				MountRetryErrnos: tt.errnos,
+				UsePrometheus:    true,
+				Registry:         registry,
+			})
+			defer cleanup()
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+			defer cancel()
+			if _, err := p.targets[0].mountWithRetries(ctx); err == nil {
+				t.Fatal("mountWithRetries() succeeded with an unknown filesystem type")
+			}
+			if got := sampleCount(t, registry, "nfs_mount_attempts_seconds"); got != tt.wantAttempts {
+				t.Errorf("mount was attempted %d times, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSampleDue(t *testing.T) {
+	targets := []Target{
+		{Address: "10.0.0.1", MountPoint: "/export"},
+		{Address: "10.0.0.2", MountPoint: "/export"},
+		{Address: "10.0.0.3", MountPoint: "/export"},
+		{Address: "10.0.0.4", MountPoint: "/export"},
+	}
+	tests := []struct {
+		name string
+		// offsets are where in each interval the ticks of each target fall
+		offsets []time.Duration
+		// latency delays every other tick
+		latency time.Duration
+	}{
+		{name: "aligned", offsets: []time.Duration{0, 0, 0, 0}},
+		{name: "staggered", offsets: []time.Duration{100 * time.Millisecond, 500 * time.Millisecond, 900 * time.Millisecond, 300 * time.Millisecond}},
+		{name: "late ticks", offsets: []time.Duration{0, 990 * time.Millisecond, 500 * time.Millisecond, 999 * time.Millisecond}, latency: 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, cleanup := newTestProber(t, Config{SampleSlices: 3, Targets: targets[:3]})
+			defer cleanup()
+			for interval := 0; interval < 12; interval++ {
+				if interval == 6 {
+					// Added mid-rotation, it moves the target after it to another slice
+					if err := p.SetTargets([]Target{targets[0], targets[3], targets[1], targets[2]}, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				probed := map[int]int{}
+				for _, n := range p.targets {
+					i := 0
+					for k, target := range targets {
+						if target == n.target {
+							i = k
+						}
+					}
+					scheduled := p.epoch.Add(time.Duration(interval)*p.config.Interval + tt.offsets[i])
+					if interval%2 == 1 {
+						scheduled = scheduled.Add(tt.latency)
+					}
+					if n.sampleDue(scheduled) {
+						probed[n.slice]++
+						if n.slice != interval%3 {
+							t.Errorf("interval %d: target %s of slice %d probed on the turn of slice %d", interval, n.target, n.slice, interval%3)
+						}
+					}
+				}
+				if len(probed) != 1 {
+					t.Errorf("interval %d: slices %v probed, want exactly slice %d", interval, probed, interval%3)
+				}
+			}
+		})
+	}
+}
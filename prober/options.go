@@ -0,0 +1,125 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cacheTimeouts are the attribute cache options that take a number of seconds.
+var cacheTimeouts = map[string]bool{"acregmin": true, "acregmax": true, "acdirmin": true, "acdirmax": true, "actimeo": true}
+
+// validateCacheOption checks the attribute cache options, ac and noac take no value
+// and the timeouts a number of seconds.
+func validateCacheOption(option string) error {
+	parts := strings.SplitN(option, "=", 2)
+	switch {
+	case parts[0] == "ac" || parts[0] == "noac":
+		if len(parts) == 2 {
+			return fmt.Errorf("invalid mount option %q, %s doesn't take a value", option, parts[0])
+		}
+	case cacheTimeouts[parts[0]]:
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid mount option %q, %s needs a number of seconds", option, parts[0])
+		}
+		if seconds, err := strconv.Atoi(parts[1]); err != nil || seconds < 0 {
+			return fmt.Errorf("invalid mount option %q, %s needs a number of seconds", option, parts[0])
+		}
+	}
+	return nil
+}
+
+// attributeCacheOff is whether options turn the attribute cache off, with noac or
+// actimeo=0.
+func attributeCacheOff(options []string) bool {
+	for _, option := range options {
+		if option == "noac" || option == "actimeo=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMountOptions splits a comma separated list of mount options into key=value
+// options, later options replace earlier ones with the same key. The kernel splits
+// mount data on every comma, so a value can't contain one.
+func parseMountOptions(list string) ([]string, error) {
+	var options []string
+	seen := map[string]int{}
+	for _, option := range strings.Split(list, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if strings.ContainsAny(option, "\"' ") {
+			return nil, fmt.Errorf("invalid mount option %q, options can't be quoted or contain spaces", option)
+		}
+		key := optionKey(option)
+		if key == "addr" {
+			return nil, fmt.Errorf("mount option %q can't be set, addr is always the target address", option)
+		}
+		if err := validateCacheOption(option); err != nil {
+			return nil, err
+		}
+		if i, ok := seen[key]; ok {
+			options[i] = option
+			continue
+		}
+		seen[key] = len(options)
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// optionKey is the part of an option before any "=", lock and nolock, hard and soft,
+// sharecache and nosharecache and ac and noac share a key so one can replace the other.
+func optionKey(option string) string {
+	key := strings.SplitN(option, "=", 2)[0]
+	switch key {
+	case "nolock":
+		return "lock"
+	case "soft":
+		return "hard"
+	case "nosharecache":
+		return "sharecache"
+	case "noac":
+		return "ac"
+	}
+	return key
+}
+
+// buildMountOptions returns the option string for a mount of address, nolock is added
+// unless the options set lock, and addr is always last.
+func buildMountOptions(options []string, address string) string {
+	built := []string{"nolock"}
+	for _, option := range options {
+		if optionKey(option) == "lock" {
+			built[0] = option
+			continue
+		}
+		built = append(built, option)
+	}
+	return strings.Join(append(built, "addr="+address), ",")
+}
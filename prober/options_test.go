@@ -0,0 +1,78 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMountOptions(t *testing.T) {
+	target := Target{Address: "10.0.0.1", MountPoint: "/export"}
+	tests := []struct {
+		name          string
+		global        string
+		targetOptions string
+		want          string
+		wantErr       bool
+	}{
+		{name: "defaults", want: "nolock,proto=tcp,addr=10.0.0.1"},
+		{name: "target after global", global: "vers=3", targetOptions: "timeo=10", want: "nolock,proto=tcp,vers=3,timeo=10,addr=10.0.0.1"},
+		{name: "target overrides global", global: "vers=3,hard", targetOptions: "vers=4.1,soft", want: "nolock,proto=tcp,vers=4.1,soft,addr=10.0.0.1"},
+		{name: "duplicates keep the last", global: "timeo=10,timeo=20", want: "nolock,proto=tcp,timeo=20,addr=10.0.0.1"},
+		{name: "lock replaces nolock", global: "lock", want: "lock,proto=tcp,addr=10.0.0.1"},
+		{name: "proto overridden", targetOptions: "proto=udp", want: "nolock,proto=udp,addr=10.0.0.1"},
+		{name: "empty options skipped", global: " ,vers=3,, ", want: "nolock,proto=tcp,vers=3,addr=10.0.0.1"},
+		{name: "global addr rejected", global: "addr=10.0.0.2", wantErr: true},
+		{name: "target addr rejected", targetOptions: "addr=10.0.0.2", wantErr: true},
+		{name: "quoted option rejected", global: `sec="krb5"`, wantErr: true},
+		{name: "invalid cache timeout rejected", targetOptions: "actimeo=soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(Config{
+				Interval:      time.Second,
+				Timeout:       time.Second,
+				Targets:       []Target{target},
+				MountOptions:  tt.global,
+				TargetOptions: map[Target]TargetOptions{target: {MountOptions: tt.targetOptions}},
+				Log:           testLogger(),
+				Registry:      prometheus.NewRegistry(),
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("New() succeeded with global options %q and target options %q", tt.global, tt.targetOptions)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New() = %v", err)
+			}
+			if got := p.MountOptions(target); got != tt.want {
+				t.Errorf("MountOptions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,838 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package prober mounts NFS targets and measures mount and read/write performance.
+package prober
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Config holds everything a Prober needs, the zero value of an optional field disables it.
+type Config struct {
+	// Targets are the NFS targets probed by Run
+	Targets []Target
+	// TargetOptions are per target settings, targets without an entry use the defaults
+	TargetOptions map[Target]TargetOptions
+	// LocalMountDir is the directory NFS targets are mounted in
+	LocalMountDir string
+	// FSType is the filesystem type passed to mount, eg nfs, nfs4
+	FSType string
+	// Interval is the time between probes of a target
+	Interval time.Duration
+	// RWInterval is the time between reading and writing test files, rounded to a
+	// multiple of Interval, defaults to Interval
+	RWInterval time.Duration
+	// Timeout is the timeout of the mount operation
+	Timeout time.Duration
+	// IOTimeout is the timeout of the read and write phase, defaults to Timeout
+	IOTimeout time.Duration
+	// MaxMountDuration is the slow mount threshold
+	MaxMountDuration time.Duration
+	// Seed seeds the startup stagger, file order and size jitter so they're the same
+	// every run, zero seeds them from the current time
+	Seed int64
+	// MaxRuntime stops Run after this long, zero runs until the context is done
+	MaxRuntime time.Duration
+	// HangThreshold is how long a mount syscall can block before it's reported as hung,
+	// zero disables the watchdog
+	HangThreshold time.Duration
+	// MountRetries is how many times a failed mount is retried within a probe, only
+	// failures with one of MountRetryErrnos are retried
+	MountRetries int
+	// MountRetryErrnos are the errors a mount is retried on, defaults to
+	// DefaultMountRetryErrnos. A timeout of the probe is never retried
+	MountRetryErrnos []syscall.Errno
+	// LatencyBuckets are the buckets of the latency histograms, nil uses the Prometheus
+	// defaults. ReadBuckets and WriteBuckets replace them for nfs_read_attempts_seconds and
+	// nfs_write_attempts_seconds. Buckets have to be in increasing order
+	LatencyBuckets []float64
+	ReadBuckets    []float64
+	WriteBuckets   []float64
+	// MinFailuresBeforeDown is how many probes in a row have to fail before nfs_status
+	// is set to 0, zero or one sets it on the first failure
+	MinFailuresBeforeDown int
+	// DNSTimeout bounds the lookup of a hostname target, zero only bounds it by Timeout
+	DNSTimeout time.Duration
+	// DNSCacheTTL is how long the address of a hostname target is reused before it's
+	// looked up again, zero looks it up on every probe
+	DNSCacheTTL time.Duration
+	// FixedTestData writes the same random content, drawn once at startup, to the test
+	// files every time instead of drawing new content for every write, so the cost of
+	// crypto/rand isn't part of the write latency. Verify rounds always use new content
+	FixedTestData bool
+	// OnDemand stops Run probing the targets, they're only probed by Probe
+	OnDemand bool
+	// RestartHungAfter is how many intervals a probe cycle can run before the target's
+	// probe goroutine is abandoned and a new one started, zero disables it
+	RestartHungAfter int
+	// ReadWrite enables reading and writing test files after each mount
+	ReadWrite bool
+	// NumOfTestFiles is the number of test files to read and write, max 5
+	NumOfTestFiles int
+	// TestFileSize is the size of each test file in bytes
+	TestFileSize int
+	// FileSizeJitter randomizes the size of each test file written by up to this
+	// percentage of TestFileSize either way, 0 disables
+	FileSizeJitter int
+	// WriteRateLimit throttles test file writes to this many bytes per second, zero
+	// is unlimited. Write durations include the throttling
+	WriteRateLimit int
+	// MtimeSkewThreshold is how far the mtime of a written test file can be from the
+	// local clock before it's logged, zero disables the warning
+	MtimeSkewThreshold time.Duration
+	// TestUID and TestGID are the filesystem uid and gid every test file, directory and
+	// symlink operation runs as, to test root-squash and export permissions, zero for
+	// both uses root
+	TestUID int
+	TestGID int
+	// TestFileMode is the mode test files are written with
+	TestFileMode os.FileMode
+	// VerifyMountTable checks a mount is in /proc/mounts with the expected filesystem
+	// type after the mount syscall succeeds
+	VerifyMountTable bool
+	// ReuseMount keeps the mount left by the previous probe while it's in the mount
+	// table and can be stat'd, rather than unmounting and mounting every probe
+	ReuseMount bool
+	// UnmountRetries is how many times a busy unmount before mounting is retried
+	// before it's lazily detached
+	UnmountRetries int
+	// UnmountBackoff is the wait before the first unmount retry, doubled each retry
+	UnmountBackoff time.Duration
+	// DirTest enables creating and removing a directory after each mount
+	DirTest bool
+	// SymlinkTest enables creating, reading and removing a symlink after each mount
+	SymlinkTest bool
+	// AppendTest enables appending a record to a test file with O_APPEND after each
+	// mount and checking the file grew by exactly the record
+	AppendTest bool
+	// AppendTruncateEvery truncates the append test file before every this many appends
+	// so it doesn't grow without bound, 0 truncates before every append
+	AppendTruncateEvery int
+	// StatTest enables a stat of the prober directory after each mount
+	StatTest bool
+	// KeepMountOnTimeout leaves the mount in place when a probe times out so it can be inspected
+	KeepMountOnTimeout bool
+	// WebhookURL is posted JSON notifications when a target starts or stops failing
+	WebhookURL string
+	// SuccessWindow is the number of latest probes the success ratio gauges are
+	// computed over, zero disables them
+	SuccessWindow int
+	// BreakerThreshold is the consecutive failures after which a target is probed less
+	// often, zero disables the circuit breaker
+	BreakerThreshold int
+	// BreakerMaxInterval is the longest a failing target goes without a probe
+	BreakerMaxInterval time.Duration
+	// Warmup is how long after starting failed probes are logged but not counted
+	// towards consecutive failures and alerts
+	Warmup time.Duration
+	// AlertAfter is the number of consecutive failures before the webhook is notified
+	AlertAfter int
+	// ReconcileOnStart unmounts orphaned mounts and removes unused directories under
+	// LocalMountDir before probing starts
+	ReconcileOnStart bool
+	// VerifyRounds is the number of times each test file is written and read back to
+	// compare its content, zero disables verification
+	VerifyRounds int
+	// DropCaches drops the cached pages of a test file before verifying it
+	DropCaches bool
+	// ReachabilityCheck dials NFSPort on the server before each mount
+	ReachabilityCheck bool
+	// NFSPort is the port dialed by the reachability check, defaults to 2049
+	NFSPort int
+	// ReadFirst reads and verifies the test files written by the previous probe before
+	// writing them again, instead of reading them back straight after writing, so data
+	// is checked to survive between probes. With PersistFiles, files are verified before
+	// any of them are written
+	ReadFirst bool
+	// CanaryFile is a file pre-seeded on the export, relative to the prober directory,
+	// read instead of writing and reading test files, so read-only exports can be
+	// probed. Its content is checked against CanarySHA256, hex, when that is set
+	CanaryFile   string
+	CanarySHA256 string
+	// SampleSlices splits the targets into this many slices that take turns, so only
+	// one slice is probed each interval and every target once every SampleSlices
+	// intervals, bounding the load of huge fleets. 0 or 1 probes every target each interval
+	SampleSlices int
+	// HistorySize is the number of latest probe results kept per target for History,
+	// 0 keeps none
+	HistorySize int
+	// FailFastIO stops a probe's test file reads or writes at the first one that fails,
+	// and skips the reads after a failed write, instead of trying every file
+	FailFastIO bool
+	// PersistFiles keeps test files between cycles, they are written once and then only
+	// read and verified, and only rewritten when verification fails
+	PersistFiles bool
+	// UseExistingMount probes targets where they are already mounted, their Path or the
+	// directory under LocalMountDir they would be mounted on, instead of mounting them.
+	// The directory must already exist on NFS. Nothing is mounted or unmounted,
+	// ReconcileOnStart is skipped and nfs_mount_attempts_seconds isn't recorded
+	UseExistingMount bool
+	// MaxFileAge rewrites a persisted test file once it was written this long ago, even
+	// when it passes verification, 0 only rewrites files that fail
+	MaxFileAge time.Duration
+	// Proto is the transport to mount over, tcp or udp, defaults to tcp. A proto in
+	// MountOptions takes precedence
+	Proto string
+	// RequireVersion fails a mount when the server negotiates another NFS version
+	// than the vers, nfsvers or minorversion in MountOptions
+	RequireVersion bool
+	// RandomFileOrder shuffles the order test files are written and read in each cycle
+	RandomFileOrder bool
+	// MountOptions are extra comma separated nfs mount options, eg sec=krb5p, added
+	// to the addr option the prober always sets and nolock unless lock is given.
+	// Repeated options use the last value and addr can't be set
+	MountOptions string
+	// ChmodTest enables chmodding test files after writing them
+	ChmodTest bool
+	// RuntimeMetrics registers the Go runtime and process collectors on Registry, so
+	// goroutine and file descriptor leaks show up in go_goroutines and process_open_fds
+	RuntimeMetrics bool
+	// ResultStream is written a JSON object per line for every completed probe cycle
+	ResultStream io.Writer
+	// OnResult is called with the result of every completed probe cycle. Failed mounts,
+	// test file writes and reads aren't logged by the prober, OnResult reports the
+	// ProbeErrors in the result, eg logging them
+	OnResult func(Result)
+	// UsePrometheus enables recording metrics
+	UsePrometheus bool
+	// Registry is where metrics are registered, defaults to prometheus.DefaultRegisterer.
+	// Each Prober needs its own registry to coexist in one process.
+	Registry prometheus.Registerer
+	// Log is the logger used for all probe results, defaults to the logrus standard logger
+	Log *logrus.Logger
+	// QuietMounts, QuietReads and QuietWrites stop successful mounts, test file reads
+	// and test file writes being logged, failures are left to OnResult
+	QuietMounts bool
+	QuietReads  bool
+	QuietWrites bool
+}
+
+// Target is an NFS export to probe.
+type Target struct {
+	// Address is the IP address or hostname of the NFS server
+	Address string `json:"address"`
+	// MountPoint is the exported directory, only its prober subdirectory is mounted
+	MountPoint string `json:"mount_point"`
+	// Variant tells apart targets probing the same export, eg with different mount options
+	Variant string `json:"variant,omitempty"`
+}
+
+func (t Target) String() string {
+	if t.Variant != "" {
+		return fmt.Sprintf("%s:%s@%s", t.Address, t.MountPoint, t.Variant)
+	}
+	return fmt.Sprintf("%s:%s", t.Address, t.MountPoint)
+}
+
+// ParseTargets parses a comma separated list of targets in the format ip:/mountPoint.
+// Several mount points on one host can be given as ip:/mountPoint;/mountPoint.
+func ParseTargets(list string) ([]Target, error) {
+	var parsed []Target
+	for _, target := range strings.Split(list, ",") {
+		s := strings.SplitN(target, ":", 2)
+		if len(s) < 2 || s[0] == "" || s[1] == "" {
+			return nil, fmt.Errorf("target %s was not in correct format", target)
+		}
+		for _, mountPoint := range strings.Split(s[1], ";") {
+			if mountPoint == "" {
+				return nil, fmt.Errorf("target %s was not in correct format", target)
+			}
+			parsed = append(parsed, Target{Address: s[0], MountPoint: mountPoint})
+			if err := ValidateTarget(parsed[len(parsed)-1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// checkDuplicates rejects a target listed more than once, eg on the command line and
+// in the config file. Both would mount on the same local directory and overwrite each
+// other's test files, a variant tells apart targets probing the same export.
+func checkDuplicates(targets []Target) error {
+	seen := map[Target]bool{}
+	for _, target := range targets {
+		if seen[target] {
+			return fmt.Errorf("target %s is listed more than once", target)
+		}
+		seen[target] = true
+	}
+	return nil
+}
+
+// ParseBuckets parses a comma separated list of histogram bucket upper bounds in
+// seconds, an empty list returns nil for the default buckets.
+func ParseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, bound := range strings.Split(list, ",") {
+		bound = strings.TrimSpace(bound)
+		if bound == "" {
+			continue
+		}
+		b, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %s: %v", bound, err)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order, %s isn't", bound)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// ValidateTarget checks target is safe to build the remote and local mount paths from,
+// so it can't reach outside the prober directory of an export or the local mount dir.
+func ValidateTarget(target Target) error {
+	if target.Address == "" || strings.ContainsAny(target.Address, "/") || target.Address == ".." {
+		return fmt.Errorf("target %s has an invalid address", target)
+	}
+	for _, part := range strings.Split(target.MountPoint, "/") {
+		if part == ".." {
+			return fmt.Errorf("target %s mount point can't contain ..", target)
+		}
+	}
+	// The variant is part of the local directory name
+	for _, c := range target.Variant {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("target %s variant can only contain letters, digits, _ and -", target)
+		}
+	}
+	return nil
+}
+
+// CheckLocalMountDir makes sure the local mount directory exists and is writable.
+func CheckLocalMountDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("could not create local mount directory %s, check the parent directory exists and is writable or set local_mount_dir: %v", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".prober-check")
+	if err != nil {
+		return fmt.Errorf("local mount directory %s is not writable, check it isn't on a read-only filesystem or volume: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Result is the outcome of a single probe cycle against a target.
+type Result struct {
+	Target Target
+	// CycleID is logged as cycle_id with every entry of the cycle
+	CycleID string
+	// Start and End are when the cycle started and finished
+	Start         time.Time
+	End           time.Time
+	MountDuration time.Duration
+	MountErr      error
+	// Stat is nil unless StatTest is enabled
+	Stat *FileResult
+	// Symlink is nil unless SymlinkTest is enabled
+	Symlink *FileResult
+	// Append is nil unless AppendTest is enabled
+	Append *FileResult
+	// Dirs are the mkdir and rmdir results, empty unless DirTest is enabled
+	Dirs   []FileResult
+	Writes []FileResult
+	Chmods []FileResult
+	Reads  []FileResult
+	// Verifies is one result per file per verify round
+	Verifies []FileResult
+}
+
+// Err returns the first error of the probe cycle, or nil if every step succeeded. It's
+// a *ProbeError, like every error in a Result returned by the prober.
+func (r Result) Err() error {
+	if r.MountErr != nil {
+		return r.MountErr
+	}
+	if r.Stat != nil && r.Stat.Err != nil {
+		return r.Stat.Err
+	}
+	if r.Symlink != nil && r.Symlink.Err != nil {
+		return r.Symlink.Err
+	}
+	if r.Append != nil && r.Append.Err != nil {
+		return r.Append.Err
+	}
+	for _, results := range [][]FileResult{r.Dirs, r.Writes, r.Chmods, r.Reads, r.Verifies} {
+		for _, result := range results {
+			if result.Err != nil {
+				return result.Err
+			}
+		}
+	}
+	return nil
+}
+
+// FileResult is the outcome of an operation on a single test file.
+type FileResult struct {
+	File     string
+	Duration time.Duration
+	Err      error
+}
+
+// Prober probes a set of NFS targets.
+type Prober struct {
+	config  Config
+	metrics *metrics
+	// mu guards targets and the targets and target options in config, see SetTargets
+	mu      sync.Mutex
+	targets []*nfs
+	// runCtx is the context of Run, nil until it's called
+	runCtx context.Context
+	// fixedTestData is drawn once for every write with FixedTestData
+	fixedTestData []byte
+	// labelNames are the custom target labels added to every per target metric
+	labelNames []string
+	// rand draws the startup stagger, file order and size jitter of every target
+	rand *lockedRand
+	// epoch is when the Prober was created, see nfs.sampleDue
+	epoch time.Time
+}
+
+// lockedRand is a Rand safe for concurrent use by the targets, so a seeded Prober
+// doesn't touch the global source other packages draw from.
+type lockedRand struct {
+	mu   sync.Mutex
+	rand *mrand.Rand
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Intn(n)
+}
+
+func (r *lockedRand) Shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rand.Shuffle(n, swap)
+}
+
+// New returns a Prober for config.
+func New(config Config) (*Prober, error) {
+	if config.Interval <= 0 {
+		return nil, errors.New("interval must be greater than zero")
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("timeout must be greater than zero")
+	}
+	for _, target := range config.Targets {
+		if err := ValidateTarget(target); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkDuplicates(config.Targets); err != nil {
+		return nil, err
+	}
+	if _, err := parseMountOptions(config.MountOptions); err != nil {
+		return nil, err
+	}
+	if err := validateCanary(config.CanaryFile, config.CanarySHA256); err != nil {
+		return nil, err
+	}
+	for target, options := range config.TargetOptions {
+		if _, err := parseMountOptions(options.MountOptions); err != nil {
+			return nil, fmt.Errorf("target %s: %v", target, err)
+		}
+		if err := validateCanary(options.CanaryFile, options.CanarySHA256); err != nil {
+			return nil, fmt.Errorf("target %s: %v", target, err)
+		}
+	}
+	if config.Proto == "" {
+		config.Proto = "tcp"
+	}
+	if config.Proto != "tcp" && config.Proto != "udp" {
+		return nil, fmt.Errorf("nfs proto must be tcp or udp, got %s", config.Proto)
+	}
+	if config.RWInterval < config.Interval {
+		config.RWInterval = config.Interval
+	}
+	if config.IOTimeout == 0 {
+		config.IOTimeout = config.Timeout
+	}
+	if config.FileSizeJitter < 0 || config.FileSizeJitter > 100 {
+		return nil, errors.New("file size jitter must be between 0 and 100 percent")
+	}
+	// Max of 5 files allowed.
+	if config.NumOfTestFiles > 5 {
+		config.NumOfTestFiles = 5
+	}
+	if config.AppendTruncateEvery <= 0 {
+		config.AppendTruncateEvery = 1
+	}
+	if config.RestartHungAfter > 0 && time.Duration(config.RestartHungAfter)*config.Interval <= config.Timeout {
+		return nil, errors.New("restart hung after must be longer than the timeout, a probe cycle can take as long as the timeout")
+	}
+	for _, buckets := range [][]float64{config.LatencyBuckets, config.ReadBuckets, config.WriteBuckets} {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return nil, errors.New("histogram buckets must be in increasing order")
+			}
+		}
+	}
+	if config.ReadBuckets == nil {
+		config.ReadBuckets = config.LatencyBuckets
+	}
+	if config.WriteBuckets == nil {
+		config.WriteBuckets = config.LatencyBuckets
+	}
+	if config.MountRetryErrnos == nil {
+		config.MountRetryErrnos = DefaultMountRetryErrnos
+	}
+	if config.BreakerMaxInterval < config.Interval {
+		config.BreakerMaxInterval = config.Interval
+	}
+	if config.NFSPort == 0 {
+		config.NFSPort = 2049
+	}
+	if config.Log == nil {
+		config.Log = logrus.StandardLogger()
+	}
+	if config.ResultStream != nil {
+		config.ResultStream = &syncWriter{w: config.ResultStream}
+	}
+	if config.Registry == nil {
+		config.Registry = prometheus.DefaultRegisterer
+	}
+	if config.UsePrometheus && config.RuntimeMetrics {
+		if err := registerRuntimeCollectors(config.Registry); err != nil {
+			return nil, fmt.Errorf("could not register runtime metrics: %v", err)
+		}
+	}
+	labelNames, err := targetLabelNames(config.Targets, config.TargetOptions)
+	if err != nil {
+		return nil, err
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	p := &Prober{
+		config:     config,
+		metrics:    newMetrics(config, labelNames),
+		labelNames: labelNames,
+		rand:       &lockedRand{rand: mrand.New(mrand.NewSource(seed))},
+		epoch:      time.Now(),
+	}
+	if config.FixedTestData {
+		// Sized for the largest file FileSizeJitter can ask for, smaller files use a prefix
+		p.fixedTestData = make([]byte, config.TestFileSize+config.TestFileSize*config.FileSizeJitter/100)
+		if _, err := crand.Read(p.fixedTestData); err != nil {
+			return nil, fmt.Errorf("could not create fixed test data: %w", err)
+		}
+	}
+	for _, target := range config.Targets {
+		n := p.newNFS(target)
+		n.setDisabled(config.TargetOptions[target].Disabled)
+		n.warnAttributeCache()
+		p.targets = append(p.targets, n)
+	}
+	if config.UsePrometheus {
+		// Computed when scraped so a hung probe keeps ageing between cycles
+		promauto.With(config.Registry).NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "nfs_oldest_inflight_probe_age_seconds",
+			Help: "age of the longest running probe of any NFS target, 0 if none are running",
+		}, p.oldestInflightAge)
+		promauto.With(config.Registry).NewGauge(prometheus.GaugeOpts{
+			Name: "nfs_prober_interval_seconds",
+			Help: "configured interval between probes of each NFS target",
+		}).Set(config.Interval.Seconds())
+		promauto.With(config.Registry).NewGauge(prometheus.GaugeOpts{
+			Name: "nfs_prober_timeout_seconds",
+			Help: "configured timeout of a probe of an NFS target",
+		}).Set(config.Timeout.Seconds())
+	}
+	return p, nil
+}
+
+// writeChunkSize is the largest chunk a rate limited test file write is split into.
+const writeChunkSize = 4096
+
+// newNFS returns the nfs probing target, mu must be held once Run has started.
+func (p *Prober) newNFS(target Target) *nfs {
+	// Targets without one of the labels get an empty value, every series needs them all
+	var labelValues []string
+	for _, name := range p.labelNames {
+		if name == "variant" {
+			labelValues = append(labelValues, target.Variant)
+			continue
+		}
+		labelValues = append(labelValues, p.config.TargetOptions[target].Labels[name])
+	}
+	numOfTestFiles := p.config.NumOfTestFiles
+	if count := p.config.TargetOptions[target].NumOfTestFiles; count > 0 {
+		numOfTestFiles = count
+	}
+	// Max of 5 files allowed.
+	if numOfTestFiles > 5 {
+		numOfTestFiles = 5
+	}
+	canaryFile, canarySHA256 := p.config.CanaryFile, p.config.CanarySHA256
+	if file := p.config.TargetOptions[target].CanaryFile; file != "" {
+		canaryFile, canarySHA256 = file, p.config.TargetOptions[target].CanarySHA256
+	}
+	targetMountOptions := p.config.TargetOptions[target].MountOptions
+	if p.sharesExport(target) {
+		// The kernel shares one superblock, and so one set of options, between mounts
+		// of the same export unless told not to
+		targetMountOptions = "nosharecache," + targetMountOptions
+	}
+	var ops map[string]bool
+	if p.config.TargetOptions[target].Ops != nil {
+		ops = map[string]bool{}
+		for _, op := range p.config.TargetOptions[target].Ops {
+			ops[op] = true
+		}
+	}
+	var writeLimiter *rate.Limiter
+	if p.config.WriteRateLimit > 0 {
+		// The burst is the most written at once, a chunk bigger than the limit would never be allowed
+		burst := writeChunkSize
+		if p.config.WriteRateLimit < burst {
+			burst = p.config.WriteRateLimit
+		}
+		writeLimiter = rate.NewLimiter(rate.Limit(p.config.WriteRateLimit), burst)
+	}
+	return &nfs{
+		stop:               make(chan struct{}),
+		writeLimiter:       writeLimiter,
+		fixedTestData:      p.fixedTestData,
+		numOfTestFiles:     numOfTestFiles,
+		slice:              p.sampleSlice(target),
+		sampleEpoch:        p.epoch,
+		canaryFile:         canaryFile,
+		canarySHA256:       canarySHA256,
+		targetMountOptions: targetMountOptions,
+		ops:                ops,
+		labelValues:        labelValues,
+		address:            target.Address,
+		localName:          p.localName(target),
+		existingDir:        p.existingDir(target),
+		// Only mount to the "prober" directory. This should not be changed.
+		mountPoint: fmt.Sprintf("%s/%s", target.MountPoint, "prober"),
+		target:     target,
+		log:        p.config.Log,
+		config:     &p.config,
+		metrics:    p.metrics,
+		rand:       p.rand,
+	}
+}
+
+// sampleSlice is the slice of target with SampleSlices, from its position in the
+// current target list. Consecutive targets take turns, so every slice has as many
+// targets as it can.
+func (p *Prober) sampleSlice(target Target) int {
+	if p.config.SampleSlices <= 1 {
+		return 0
+	}
+	for i, t := range p.config.Targets {
+		if t == target {
+			return i % p.config.SampleSlices
+		}
+	}
+	return 0
+}
+
+// localName is the name of the directory a target is mounted on under LocalMountDir.
+// It's the address, unless other targets share it, then the mount point keeps them apart.
+// A variant is always added after an @.
+func (p *Prober) localName(target Target) string {
+	name := target.Address
+	for _, t := range p.config.Targets {
+		if t.Address == target.Address && t != target {
+			name = target.Address + strings.Replace(target.MountPoint, "/", "_", -1)
+			break
+		}
+	}
+	if target.Variant != "" {
+		name += "@" + target.Variant
+	}
+	return name
+}
+
+// existingDir is the prober directory under the path a target is already mounted on
+// with UseExistingMount, empty when the prober mounts the target itself.
+func (p *Prober) existingDir(target Target) string {
+	path := p.config.TargetOptions[target].Path
+	if !p.config.UseExistingMount || path == "" {
+		return ""
+	}
+	return filepath.Join(path, "prober")
+}
+
+// sharesExport is whether another configured target probes the same export as target.
+func (p *Prober) sharesExport(target Target) bool {
+	for _, t := range p.config.Targets {
+		if t.Address == target.Address && t.MountPoint == target.MountPoint && t != target {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalDir returns the local directory target is mounted on.
+func (p *Prober) LocalDir(target Target) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dir := p.existingDir(target); dir != "" {
+		return dir
+	}
+	return fmt.Sprintf("%s/%s", p.config.LocalMountDir, p.localName(target))
+}
+
+// MountOptions returns the options target is mounted with.
+func (p *Prober) MountOptions(target Target) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.newNFS(target).mountOptions(target.Address)
+}
+
+// Run probes every configured target at the configured interval until ctx is done.
+// With MaxRuntime it returns once that has passed. Every target is unmounted on return.
+func (p *Prober) Run(ctx context.Context) {
+	if p.config.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.MaxRuntime)
+		defer cancel()
+	}
+	defer p.unmountAll(ctx)
+	// Existing mounts under LocalMountDir aren't the prober's to unmount
+	if p.config.ReconcileOnStart && !p.config.UseExistingMount {
+		p.reconcile()
+	}
+	// Targets added by SetTargets from now on are started by it
+	p.mu.Lock()
+	p.runCtx = ctx
+	p.mu.Unlock()
+	if p.config.OnDemand {
+		<-ctx.Done()
+		return
+	}
+	// Loop through all targets and start probes concurrently
+	for _, n := range p.targetList() {
+		// Wait a random amount of time from 0 - 30s so targets don't start at the same time
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.rand.Intn(30)) * time.Second):
+		}
+		p.start(ctx, n)
+	}
+	<-ctx.Done()
+}
+
+// unmountAll unmounts every target once probing has stopped.
+func (p *Prober) unmountAll(ctx context.Context) {
+	targets := p.targetList()
+	for _, n := range targets {
+		n.unmount(ctx)
+	}
+	p.config.Log.WithFields(logrus.Fields{"targets": len(targets)}).Info("stopped probing, unmounted targets")
+}
+
+// Probe runs a single probe cycle against target. The returned error is the mount
+// error, a *ProbeError, nothing else is probed when the mount fails.
+func (p *Prober) Probe(ctx context.Context, target Target) (Result, error) {
+	n := p.lookup(target)
+	if n == nil {
+		if err := ValidateTarget(target); err != nil {
+			err = newProbeError("mount", target, "", err)
+			return Result{Target: target, MountErr: err}, err
+		}
+		p.mu.Lock()
+		n = p.newNFS(target)
+		p.mu.Unlock()
+	}
+	// Concurrent cycles of a target would unmount each other
+	n.probeMu.Lock()
+	defer n.probeMu.Unlock()
+	result := n.probe(ctx)
+	return result, result.MountErr
+}
+
+// SetEnabled pauses or resumes probing target. Pausing deletes its metric series but
+// nfs_target_disabled, so alerts don't fire on the last values of a paused target.
+func (p *Prober) SetEnabled(target Target, enabled bool) error {
+	n := p.lookup(target)
+	if n == nil {
+		return fmt.Errorf("target %s is not configured", target)
+	}
+	n.setDisabled(!enabled)
+	if !enabled {
+		n.deleteSeries(n.metrics.targetDisabled)
+	}
+	n.log.WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "enabled": enabled}).Info("target probing toggled")
+	return nil
+}
+
+// Configured is whether target is one of the configured targets, targets supplied at
+// runtime should be checked against it before being acted on.
+func (p *Prober) Configured(target Target) bool {
+	return p.lookup(target) != nil
+}
+
+// lookup returns the configured target matching target, or nil if there isn't one.
+func (p *Prober) lookup(target Target) *nfs {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, n := range p.targets {
+		if n.target == target {
+			return n
+		}
+	}
+	return nil
+}
+
+// withContext runs fn in its own goroutine and returns the context error if it is done first.
+// A blocked file operation can't be cancelled, so it's left to finish in the background.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,248 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+// newTestProber returns a Prober of a single target whose local directory is a
+// temporary directory, so the test file operations run without a mount.
+func newTestProber(t *testing.T, config Config) (*Prober, func()) {
+	dir, err := ioutil.TempDir("", "prober-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Interval = time.Second
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	config.LocalMountDir = dir
+	config.Log = testLogger()
+	if config.Registry == nil {
+		config.Registry = prometheus.NewRegistry()
+	}
+	if config.Targets == nil {
+		config.Targets = []Target{{Address: "10.0.0.1", MountPoint: "/export"}}
+	}
+	p, err := New(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, n := range p.targets {
+		if err := os.MkdirAll(n.localDir(), 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func TestValidateTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  Target
+		wantErr bool
+	}{
+		{name: "valid", target: Target{Address: "10.0.0.1", MountPoint: "/export/data"}},
+		{name: "dots in a name", target: Target{Address: "nfs.example.com", MountPoint: "/export/..data"}},
+		{name: "valid variant", target: Target{Address: "10.0.0.1", MountPoint: "/export", Variant: "v4_1-tcp"}},
+		{name: "empty address", target: Target{MountPoint: "/export"}, wantErr: true},
+		{name: "address with a slash", target: Target{Address: "10.0.0.1/..", MountPoint: "/export"}, wantErr: true},
+		{name: "address is ..", target: Target{Address: "..", MountPoint: "/export"}, wantErr: true},
+		{name: "mount point is ..", target: Target{Address: "10.0.0.1", MountPoint: ".."}, wantErr: true},
+		{name: "mount point escapes", target: Target{Address: "10.0.0.1", MountPoint: "/export/../../etc"}, wantErr: true},
+		{name: "mount point ends in ..", target: Target{Address: "10.0.0.1", MountPoint: "/export/.."}, wantErr: true},
+		{name: "variant with a slash", target: Target{Address: "10.0.0.1", MountPoint: "/export", Variant: "../v4"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTarget(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTarget(%s) = %v, want error %v", tt.target, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadTestFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		missing bool
+		wantErr bool
+		// wantNotExist is whether the error matches os.ErrNotExist
+		wantNotExist bool
+	}{
+		{name: "expected size", content: "12345678"},
+		{name: "short", content: "1234", wantErr: true},
+		{name: "empty", content: "", wantErr: true},
+		{name: "long", content: "123456789", wantErr: true},
+		{name: "missing", missing: true, wantErr: true, wantNotExist: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, cleanup := newTestProber(t, Config{TestFileSize: 8, NumOfTestFiles: 1})
+			defer cleanup()
+			n := p.targets[0]
+			if !tt.missing {
+				if err := ioutil.WriteFile(n.testFileLocation(0), []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			results := n.readTestFiles(context.Background(), []int{0})
+			if len(results) != 1 {
+				t.Fatalf("readTestFiles() returned %d results, want exactly 1", len(results))
+			}
+			if (results[0].Err != nil) != tt.wantErr {
+				t.Errorf("readTestFiles() error = %v, want error %v", results[0].Err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			var probeErr *ProbeError
+			if !errors.As(results[0].Err, &probeErr) || probeErr.Op != "read" || probeErr.File != n.testFileLocation(0) || probeErr.Target != n.target {
+				t.Errorf("readTestFiles() error = %#v, want a ProbeError of reading %s", results[0].Err, n.testFileLocation(0))
+			}
+			if errors.Is(results[0].Err, os.ErrNotExist) != tt.wantNotExist {
+				t.Errorf("errors.Is(%v, os.ErrNotExist) = %v, want %v", results[0].Err, !tt.wantNotExist, tt.wantNotExist)
+			}
+		})
+	}
+}
+
+func TestReadFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		// preexisting is written before the first cycle, as if left by another process
+		preexisting bool
+		// corrupt overwrites file 0 between the cycles
+		corrupt      bool
+		wantReadErrs int
+	}{
+		{name: "intact"},
+		{name: "corrupted between cycles", corrupt: true, wantReadErrs: 1},
+		{name: "pre-existing file isn't read", preexisting: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, cleanup := newTestProber(t, Config{TestFileSize: 16, NumOfTestFiles: 3, ReadWrite: true, ReadFirst: true})
+			defer cleanup()
+			n := p.targets[0]
+			ctx := context.Background()
+			// Successful reads and writes are logged as they run, which gives their order
+			n.config.QuietReads, n.config.QuietWrites = false, false
+			hook := test.NewLocal(n.log)
+			if tt.preexisting {
+				if err := ioutil.WriteFile(n.testFileLocation(0), []byte("left by someone"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var first Result
+			n.testFiles(ctx, ctx, &first)
+			if len(first.Reads) != 0 {
+				t.Errorf("first cycle read %d files, want none before anything is written", len(first.Reads))
+			}
+			if len(first.Writes) != 3 || !allSucceeded(first.Writes) {
+				t.Fatalf("first cycle writes = %v, want 3 successful writes", first.Writes)
+			}
+
+			if tt.corrupt {
+				if err := ioutil.WriteFile(n.testFileLocation(0), make([]byte, 16), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hook.Reset()
+			var second Result
+			n.testFiles(ctx, ctx, &second)
+			var ops []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "read test file" || entry.Message == "write test file" {
+					ops = append(ops, entry.Message)
+				}
+			}
+			if len(ops) == 0 || ops[0] != "read test file" {
+				t.Errorf("second cycle logged %v, want a read first", ops)
+			}
+			if len(second.Reads) != 3 {
+				t.Fatalf("second cycle read %d files, want 3", len(second.Reads))
+			}
+			readErrs := 0
+			for _, read := range second.Reads {
+				if read.Err != nil {
+					readErrs++
+				}
+			}
+			if readErrs != tt.wantReadErrs {
+				t.Errorf("second cycle had %d failed reads, want %d: %v", readErrs, tt.wantReadErrs, second.Reads)
+			}
+			// The reads ran first, so the corrupted file is only replaced afterwards
+			if len(second.Writes) != 3 || !allSucceeded(second.Writes) {
+				t.Errorf("second cycle writes = %v, want 3 successful writes after the reads", second.Writes)
+			}
+		})
+	}
+}
+
+func TestProbeInjectedFailure(t *testing.T) {
+	var reported []Result
+	p, cleanup := newTestProber(t, Config{OnResult: func(result Result) {
+		reported = append(reported, result)
+	}})
+	defer cleanup()
+	target := p.targets[0].target
+	if err := p.InjectFailure(target, 1); err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Probe(context.Background(), target)
+	var probeErr *ProbeError
+	if !errors.As(err, &probeErr) || probeErr.Op != "mount" || probeErr.Reason != "injected" || probeErr.Target != target {
+		t.Fatalf("Probe() error = %#v, want an injected mount ProbeError", err)
+	}
+	if !errors.Is(err, errInjected) {
+		t.Errorf("errors.Is(%v, errInjected) = false, want true", err)
+	}
+	if result.Err() != err {
+		t.Errorf("Result.Err() = %v, want the returned error %v", result.Err(), err)
+	}
+	if len(reported) != 1 || reported[0].MountErr != err {
+		t.Errorf("OnResult got %v, want the result of the probe", reported)
+	}
+}
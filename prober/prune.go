@@ -0,0 +1,109 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// vec is a metric vector whose series can be deleted.
+type vec interface {
+	prometheus.Collector
+	Delete(prometheus.Labels) bool
+}
+
+// perTarget are the metric vectors with a series per target, every one but
+// nfs_server_reachable, which is per server.
+func (m *metrics) perTarget() []vec {
+	return []vec{
+		m.status, m.mountAttempts, m.readAttempts, m.writeAttempts, m.fileModeMatch,
+		m.chmodAttempts, m.mountHung, m.mountSlow, m.testFilesPresent, m.probeInProgress,
+		m.statAttempts, m.mountErrors, m.verifyMatchRatio, m.targetDisabled,
+		m.timeToFirstSuccess, m.localSetupFailures, m.staleHandleRecoveries,
+		m.unmountRetries, m.mountSuccessRatio, m.readSuccessRatio, m.writeSuccessRatio,
+		m.writesSkipped, m.mkdirAttempts, m.rmdirAttempts, m.symlinkAttempts,
+		m.unmountAttempts, m.version, m.breakerState, m.mtimeSkew, m.goroutineRestarts,
+		m.bytesWritten, m.bytesRead, m.mountRetries, m.scheduleDrift, m.dataPathStatus,
+		m.dnsResolve, m.appendAttempts, m.canaryMatch, m.sampledProbes,
+	}
+}
+
+// deleteSeries deletes every series of the target from the metric vectors but keep.
+// A target's series are the ones with its address, mount point and target label
+// values, whatever their own labels, so the label values don't have to be known.
+func (n *nfs) deleteSeries(keep ...vec) {
+	if !n.config.UsePrometheus {
+		return
+	}
+	match := map[string]string{"address": n.address, "mount_point": n.mountPoint}
+	for i, name := range n.metrics.targetLabels {
+		match[name] = n.labelValues[i]
+	}
+	kept := map[vec]bool{}
+	for _, v := range keep {
+		kept[v] = true
+	}
+	for _, v := range n.metrics.perTarget() {
+		if kept[v] {
+			continue
+		}
+		for _, labels := range seriesLabels(v) {
+			if matches(labels, match) {
+				v.Delete(labels)
+			}
+		}
+	}
+}
+
+// seriesLabels returns the labels of every series of v. They are collected before
+// any is deleted, Delete would block on the lock Collect holds.
+func seriesLabels(v vec) []prometheus.Labels {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		v.Collect(ch)
+		close(ch)
+	}()
+	var all []prometheus.Labels
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		labels := prometheus.Labels{}
+		for _, pair := range m.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		all = append(all, labels)
+	}
+	return all
+}
+
+func matches(labels prometheus.Labels, match map[string]string) bool {
+	for name, value := range match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
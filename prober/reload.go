@@ -0,0 +1,163 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetTargets replaces the probed targets and their settings, eg after the config file
+// changed. Targets that are gone or whose settings changed are stopped and unmounted,
+// and the metric series of the ones that are gone are deleted, new and changed ones start probing on their next interval with fresh state. The
+// custom target labels are part of every metric series, so targets needing other
+// label names are refused until a restart.
+func (p *Prober) SetTargets(targets []Target, options map[Target]TargetOptions) error {
+	for _, target := range targets {
+		if err := ValidateTarget(target); err != nil {
+			return err
+		}
+	}
+	if err := checkDuplicates(targets); err != nil {
+		return err
+	}
+	for target, option := range options {
+		if _, err := parseMountOptions(option.MountOptions); err != nil {
+			return fmt.Errorf("target %s: %v", target, err)
+		}
+		if err := validateCanary(option.CanaryFile, option.CanarySHA256); err != nil {
+			return fmt.Errorf("target %s: %v", target, err)
+		}
+	}
+	labelNames, err := targetLabelNames(targets, options)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(labelNames, p.labelNames) {
+		return fmt.Errorf("target labels would change from %v to %v, restart the prober to apply it", p.labelNames, labelNames)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	oldOptions := p.config.TargetOptions
+	p.config.Targets = targets
+	p.config.TargetOptions = options
+	current := map[Target]*nfs{}
+	for _, n := range p.targets {
+		current[n.target] = n
+	}
+	var kept, started []*nfs
+	var added, removed int
+	for _, target := range targets {
+		n, ok := current[target]
+		// The local directory depends on the other targets, a new one can move it
+		if ok && reflect.DeepEqual(oldOptions[target], options[target]) && n.localName == p.localName(target) {
+			delete(current, target)
+			kept = append(kept, n)
+			continue
+		}
+		n = p.newNFS(target)
+		n.setDisabled(options[target].Disabled)
+		n.warnAttributeCache()
+		kept = append(kept, n)
+		started = append(started, n)
+		added++
+	}
+	// Everything left over is gone or replaced
+	unmounted := map[string]chan struct{}{}
+	for _, n := range current {
+		close(n.stop)
+		// A replacement with the same label values takes the series over
+		prune := true
+		for _, k := range kept {
+			if k.target == n.target && reflect.DeepEqual(k.labelValues, n.labelValues) {
+				prune = false
+			}
+		}
+		done := make(chan struct{})
+		unmounted[n.localDir()] = done
+		go func(n *nfs) {
+			defer close(done)
+			if p.runCtx != nil {
+				n.unmount(p.runCtx)
+			}
+			// After unmounting, which records the unmount
+			if prune {
+				n.deleteSeries()
+			}
+		}(n)
+		removed++
+	}
+	if ctx := p.runCtx; ctx != nil {
+		for _, n := range started {
+			done, ok := unmounted[n.localDir()]
+			if !ok {
+				p.start(ctx, n)
+				continue
+			}
+			// On the local directory of a removed target, eg after a changed variant or
+			// mount options, whose unmount would otherwise take the new mount down
+			go func(n *nfs) {
+				<-done
+				p.start(ctx, n)
+			}(n)
+		}
+	}
+	// Kept targets move up or down the list as others come and go
+	for _, n := range kept {
+		n.setSlice(p.sampleSlice(n.target))
+	}
+	p.targets = kept
+	p.config.Log.WithFields(logrus.Fields{"targets": len(kept), "started": added, "stopped": removed}).Info("targets updated")
+	return nil
+}
+
+// start probes n until ctx is done or n is removed by SetTargets.
+func (p *Prober) start(ctx context.Context, n *nfs) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-n.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	if p.config.HangThreshold > 0 {
+		go n.watchdog(ctx)
+	}
+	if p.config.RestartHungAfter > 0 {
+		go n.supervise(ctx)
+		return
+	}
+	go n.test(ctx, 0)
+}
+
+// targetList returns the current targets, safe to range over while they're replaced.
+func (p *Prober) targetList() []*nfs {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*nfs(nil), p.targets...)
+}
@@ -0,0 +1,90 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestSetTargetsNumOfTestFiles(t *testing.T) {
+	target := Target{Address: "10.0.0.1", MountPoint: "/export"}
+	tests := []struct {
+		name      string
+		before    int
+		after     int
+		wantFiles int
+	}{
+		{name: "smaller", before: 5, after: 2, wantFiles: 2},
+		{name: "down to one", before: 3, after: 1, wantFiles: 1},
+		{name: "unchanged", before: 3, after: 3, wantFiles: 3},
+		{name: "larger", before: 2, after: 4, wantFiles: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, cleanup := newTestProber(t, Config{
+				TestFileSize:  8,
+				ReadWrite:     true,
+				Targets:       []Target{target},
+				TargetOptions: map[Target]TargetOptions{target: {NumOfTestFiles: tt.before}},
+			})
+			defer cleanup()
+			ctx := context.Background()
+			var result Result
+			p.targets[0].testFiles(ctx, ctx, &result)
+
+			if err := p.SetTargets([]Target{target}, map[Target]TargetOptions{target: {NumOfTestFiles: tt.after}}); err != nil {
+				t.Fatalf("SetTargets() = %v", err)
+			}
+			n := p.targets[0]
+			result = Result{}
+			n.testFiles(ctx, ctx, &result)
+			if len(result.Writes) != tt.wantFiles || len(result.Reads) != tt.wantFiles {
+				t.Errorf("cycle after reload wrote %d and read %d files, want %d", len(result.Writes), len(result.Reads), tt.wantFiles)
+			}
+			if err := result.Err(); err != nil {
+				t.Errorf("cycle after reload failed: %v", err)
+			}
+			// Files past the new count are stale and removed
+			entries, err := ioutil.ReadDir(n.localDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if len(names) != tt.wantFiles {
+				t.Fatalf("prober directory has %v after reload, want %d test files", names, tt.wantFiles)
+			}
+			for i, name := range names {
+				if name != strconv.Itoa(i) {
+					t.Errorf("prober directory has %v after reload, want files 0 to %d", names, tt.wantFiles-1)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TargetStatus is the latest state of a target.
+type TargetStatus struct {
+	Target              Target    `json:"target"`
+	LastProbe           time.Time `json:"last_probe"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Disabled            bool      `json:"disabled"`
+}
+
+// Status is the latest state of every configured target.
+type Status struct {
+	Targets []TargetStatus `json:"targets"`
+	// Pending is the number of enabled targets that haven't had a successful probe yet
+	Pending int `json:"pending"`
+}
+
+// window is a ring buffer of the outcomes of the latest probes of an operation.
+type window struct {
+	outcomes []bool
+	next     int
+}
+
+// add records an outcome, replacing the oldest once size outcomes are recorded.
+func (w *window) add(ok bool, size int) {
+	if len(w.outcomes) < size {
+		w.outcomes = append(w.outcomes, ok)
+		return
+	}
+	w.outcomes[w.next] = ok
+	w.next = (w.next + 1) % size
+}
+
+// ratio is the fraction of successful outcomes in the window.
+func (w *window) ratio() float64 {
+	if len(w.outcomes) == 0 {
+		return 0
+	}
+	succeeded := 0
+	for _, ok := range w.outcomes {
+		if ok {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(len(w.outcomes))
+}
+
+// allSucceeded is whether every file operation in results succeeded.
+func allSucceeded(results []FileResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// updateWindows records the mount, write and read outcomes of a probe cycle in the
+// target's success windows, phases that didn't run aren't recorded.
+func (n *nfs) updateWindows(result Result) {
+	if n.config.SuccessWindow <= 0 {
+		return
+	}
+	n.mu.Lock()
+	n.mountWindow.add(result.MountErr == nil, n.config.SuccessWindow)
+	if len(result.Writes) > 0 {
+		n.writeWindow.add(allSucceeded(result.Writes), n.config.SuccessWindow)
+	}
+	if len(result.Reads) > 0 {
+		n.readWindow.add(allSucceeded(result.Reads), n.config.SuccessWindow)
+	}
+	mount, write, read := n.mountWindow.ratio(), n.writeWindow.ratio(), n.readWindow.ratio()
+	n.mu.Unlock()
+	if n.config.UsePrometheus {
+		n.metrics.mountSuccessRatio.WithLabelValues(n.labels()...).Set(mount)
+		if len(result.Writes) > 0 {
+			n.metrics.writeSuccessRatio.WithLabelValues(n.labels()...).Set(write)
+		}
+		if len(result.Reads) > 0 {
+			n.metrics.readSuccessRatio.WithLabelValues(n.labels()...).Set(read)
+		}
+	}
+}
+
+// updateDataPath sets nfs_data_path_status for reads and writes, so a target that can
+// be read but not written shows apart from one that's down. A failed mount fails both
+// paths the target probes, a path that didn't run keeps its last value.
+func (n *nfs) updateDataPath(result Result) {
+	if !n.config.UsePrometheus {
+		return
+	}
+	if result.MountErr != nil {
+		if n.opEnabled("read") {
+			n.metrics.dataPathStatus.WithLabelValues(n.labels("read")...).Set(0)
+		}
+		if n.opEnabled("write") && !n.readOnly() {
+			n.metrics.dataPathStatus.WithLabelValues(n.labels("write")...).Set(0)
+		}
+		return
+	}
+	set := func(path string, results []FileResult) {
+		if len(results) == 0 {
+			return
+		}
+		status := 0.0
+		if allSucceeded(results) {
+			status = 1
+		}
+		n.metrics.dataPathStatus.WithLabelValues(n.labels(path)...).Set(status)
+	}
+	set("write", result.Writes)
+	set("read", result.Reads)
+}
+
+// statusDown sets nfs_status to 0 for a failing probe, unless fewer than
+// MinFailuresBeforeDown probes in a row have failed, counting the running one. Until
+// then nfs_status keeps its last value, or stays unset before the first probe.
+func (n *nfs) statusDown() {
+	if !n.config.UsePrometheus {
+		return
+	}
+	n.mu.Lock()
+	failures := n.consecutiveFailures + 1
+	n.mu.Unlock()
+	if failures < n.config.MinFailuresBeforeDown {
+		return
+	}
+	n.metrics.status.WithLabelValues(n.labels()...).Set(0)
+}
+
+// recordResult updates the target's state with the result of a probe cycle.
+func (n *nfs) recordResult(ctx context.Context, result Result) {
+	n.updateWindows(result)
+	n.updateDataPath(result)
+	err := result.Err()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.addHistory(result)
+	n.lastProbe = time.Now()
+	n.lastErr = err
+	if err != nil && n.lastProbe.Sub(processStart) < n.config.Warmup {
+		// Expected cold start failures, eg DNS or routing still settling, aren't counted
+		// towards alerts
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err}).Info("probe failed during warmup, not counted")
+		return
+	}
+	if err != nil {
+		n.consecutiveFailures++
+		n.consecutiveSuccesses = 0
+		return
+	}
+	n.lastSuccess = n.lastProbe
+	n.consecutiveFailures = 0
+	n.consecutiveSuccesses++
+}
+
+// addHistory keeps result in the target's history, replacing the oldest once
+// HistorySize results are kept. n.mu must be held.
+func (n *nfs) addHistory(result Result) {
+	if n.config.HistorySize <= 0 {
+		return
+	}
+	if len(n.history) < n.config.HistorySize {
+		n.history = append(n.history, result)
+		return
+	}
+	n.history[n.historyNext] = result
+	n.historyNext = (n.historyNext + 1) % n.config.HistorySize
+}
+
+// latestHistory returns up to limit of the latest results of the target, oldest first,
+// every kept result when limit is 0.
+func (n *nfs) latestHistory(limit int) []Result {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ordered := append(append([]Result{}, n.history[n.historyNext:]...), n.history[:n.historyNext]...)
+	if limit > 0 && limit < len(ordered) {
+		ordered = ordered[len(ordered)-limit:]
+	}
+	return ordered
+}
+
+// History returns up to limit of the latest probe results of target, oldest first,
+// every kept result when limit is 0. At most HistorySize results are kept per target.
+func (p *Prober) History(target Target, limit int) ([]Result, error) {
+	n := p.lookup(target)
+	if n == nil {
+		return nil, fmt.Errorf("target %s is not configured", target)
+	}
+	return n.latestHistory(limit), nil
+}
+
+func (n *nfs) status() TargetStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	status := TargetStatus{
+		Target:              n.target,
+		LastProbe:           n.lastProbe,
+		LastSuccess:         n.lastSuccess,
+		Healthy:             !n.lastProbe.IsZero() && n.lastErr == nil,
+		ConsecutiveFailures: n.consecutiveFailures,
+		Disabled:            n.disabled,
+	}
+	if n.lastErr != nil {
+		status.LastError = n.lastErr.Error()
+	}
+	return status
+}
+
+// Status returns the latest state of every configured target.
+func (p *Prober) Status() Status {
+	var status Status
+	for _, n := range p.targetList() {
+		targetStatus := n.status()
+		if targetStatus.LastSuccess.IsZero() && !targetStatus.Disabled {
+			status.Pending++
+		}
+		status.Targets = append(status.Targets, targetStatus)
+	}
+	return status
+}
+
+// oldestInflightAge is the age in seconds of the longest running probe cycle of any
+// target, zero if none are running.
+func (p *Prober) oldestInflightAge() float64 {
+	var oldest time.Duration
+	for _, n := range p.targetList() {
+		n.mu.Lock()
+		if !n.probeStart.IsZero() && time.Since(n.probeStart) > oldest {
+			oldest = time.Since(n.probeStart)
+		}
+		n.mu.Unlock()
+	}
+	return oldest.Seconds()
+}
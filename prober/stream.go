@@ -0,0 +1,150 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resultRecord is the JSON encoding of a Result, written to the result stream for each
+// probe cycle, its fields are a stable schema for log pipelines.
+type resultRecord struct {
+	Target        string       `json:"target"`
+	Address       string       `json:"address"`
+	MountPoint    string       `json:"mount_point"`
+	CycleID       string       `json:"cycle_id"`
+	Start         time.Time    `json:"start"`
+	End           time.Time    `json:"end"`
+	Success       bool         `json:"success"`
+	Error         string       `json:"error,omitempty"`
+	MountDuration float64      `json:"mount_duration_seconds"`
+	Stat          *fileRecord  `json:"stat,omitempty"`
+	Dirs          []fileRecord `json:"dirs,omitempty"`
+	Symlink       *fileRecord  `json:"symlink,omitempty"`
+	Append        *fileRecord  `json:"append,omitempty"`
+	Writes        []fileRecord `json:"writes,omitempty"`
+	Chmods        []fileRecord `json:"chmods,omitempty"`
+	Reads         []fileRecord `json:"reads,omitempty"`
+	Verifies      []fileRecord `json:"verifies,omitempty"`
+}
+
+type fileRecord struct {
+	File     string  `json:"file"`
+	Duration float64 `json:"duration_seconds"`
+	Success  bool    `json:"success"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func newFileRecords(results []FileResult) []fileRecord {
+	var records []fileRecord
+	for _, r := range results {
+		records = append(records, newFileRecord(r))
+	}
+	return records
+}
+
+func newFileRecord(r FileResult) fileRecord {
+	record := fileRecord{File: r.File, Duration: r.Duration.Seconds(), Success: r.Err == nil}
+	if r.Err != nil {
+		record.Error = r.Err.Error()
+		// The record already has the file, the operation is the list it's in
+		var probeErr *ProbeError
+		if errors.As(r.Err, &probeErr) {
+			record.Error = probeErr.Err.Error()
+		}
+	}
+	return record
+}
+
+// syncWriter serializes writes from the targets' goroutines so lines don't interleave.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+// MarshalJSON encodes r in the result stream schema.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newResultRecord(r))
+}
+
+func newResultRecord(result Result) resultRecord {
+	record := resultRecord{
+		Target:        result.Target.String(),
+		Address:       result.Target.Address,
+		MountPoint:    fmt.Sprintf("%s/%s", result.Target.MountPoint, "prober"),
+		CycleID:       result.CycleID,
+		Start:         result.Start,
+		End:           result.End,
+		Success:       result.Err() == nil,
+		MountDuration: result.MountDuration.Seconds(),
+		Dirs:          newFileRecords(result.Dirs),
+		Writes:        newFileRecords(result.Writes),
+		Chmods:        newFileRecords(result.Chmods),
+		Reads:         newFileRecords(result.Reads),
+		Verifies:      newFileRecords(result.Verifies),
+	}
+	if err := result.Err(); err != nil {
+		record.Error = err.Error()
+	}
+	if result.Symlink != nil {
+		symlink := newFileRecord(*result.Symlink)
+		record.Symlink = &symlink
+	}
+	if result.Append != nil {
+		appended := newFileRecord(*result.Append)
+		record.Append = &appended
+	}
+	if result.Stat != nil {
+		stat := newFileRecord(*result.Stat)
+		record.Stat = &stat
+	}
+	return record
+}
+
+// writeResult writes result to the result stream as a single line of JSON.
+func (n *nfs) writeResult(ctx context.Context, result Result) {
+	if n.config.ResultStream == nil {
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if _, err := n.config.ResultStream.Write(append(b, '\n')); err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err}).Warn("could not write result stream")
+	}
+}
@@ -0,0 +1,83 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testLinkName is the name of the symlink created by the symlink test.
+const testLinkName = ".prober-link"
+
+// symlinkTest creates a symlink to the first test file, reads it back and removes it.
+func (n *nfs) symlinkTest(ctx context.Context) *FileResult {
+	link := fmt.Sprintf("%s/%s", n.localDir(), testLinkName)
+	// Relative, so the link resolves wherever the export is mounted
+	target := "0"
+	startTime := time.Now()
+	err := withContext(ctx, func() error {
+		return n.asTestIdentity(func() error {
+			// Left behind by a crashed probe, it would make the symlink fail with EEXIST
+			if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(target, link); err != nil {
+				return err
+			}
+			got, err := os.Readlink(link)
+			if err != nil {
+				return err
+			}
+			if got != target {
+				return fmt.Errorf("symlink points to %s, expected %s", got, target)
+			}
+			return os.Remove(link)
+		})
+	})
+	elapsed := time.Since(startTime)
+	duration := elapsed.Seconds()
+	if err != nil {
+		success := "false"
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) {
+			// The export doesn't allow symlinks rather than failing to create one
+			success = "unsupported"
+		}
+		n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": duration, "file": link, "result": success}).Warn("could not create test symlink")
+		if n.config.UsePrometheus {
+			n.metrics.symlinkAttempts.WithLabelValues(n.labels(success)...).Observe(duration)
+		}
+		return &FileResult{File: link, Duration: elapsed, Err: err}
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": duration, "file": link}).Info("created test symlink")
+	if n.config.UsePrometheus {
+		n.metrics.symlinkAttempts.WithLabelValues(n.labels("true")...).Observe(duration)
+	}
+	return &FileResult{File: link, Duration: elapsed}
+}
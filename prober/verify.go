@@ -0,0 +1,119 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// verifyTestFiles writes each test file then reads it back VerifyRounds times,
+// comparing the content. A single check can be satisfied by a caching layer, so the
+// fraction of matching rounds is reported to surface intermittent corruption.
+func (n *nfs) verifyTestFiles(ctx context.Context) []FileResult {
+	var results []FileResult
+	matched, total := 0, 0
+	for round := 0; round < n.config.VerifyRounds; round++ {
+		for i := 0; i < n.numOfTestFiles; i++ {
+			i := i
+			testFileLocation := n.testFileLocation(i)
+			startTime := time.Now()
+			err := withContext(ctx, func() error {
+				return n.asTestIdentity(func() error {
+					return n.verifyTestFile(i, testFileLocation)
+				})
+			})
+			elapsed := time.Since(startTime)
+			total++
+			results = append(results, FileResult{File: testFileLocation, Duration: elapsed, Err: err})
+			if err != nil {
+				n.logger(ctx).WithFields(logrus.Fields{"success": false, "address": n.address, "mountPoint": n.mountPoint, "err": err, "duration": elapsed.Seconds(), "file": testFileLocation, "round": round}).Warn("could not verify test file")
+				continue
+			}
+			matched++
+			if !n.config.QuietReads {
+				n.logger(ctx).WithFields(logrus.Fields{"success": true, "address": n.address, "mountPoint": n.mountPoint, "duration": elapsed.Seconds(), "file": testFileLocation, "round": round}).Info("verified test file")
+			}
+		}
+	}
+	if n.config.UsePrometheus && total > 0 {
+		n.metrics.verifyMatchRatio.WithLabelValues(n.labels()...).Set(float64(matched) / float64(total))
+	}
+	return results
+}
+
+// verifyTestFile writes random content to test file i and checks it reads back the
+// same. The new size and checksum are recorded like any other write, so later reads
+// of the file expect the content of the last verify round.
+func (n *nfs) verifyTestFile(i int, testFileLocation string) error {
+	b := make([]byte, n.newFileSize())
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	n.setFileSize(i, len(b))
+	w, err := os.OpenFile(testFileLocation, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, n.config.TestFileMode)
+	if err != nil {
+		return err
+	}
+	written, err := w.Write(b)
+	n.countWritten(written)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n.config.PersistFiles || n.config.ReadFirst {
+		n.setChecksum(i, sha256.Sum256(b))
+	}
+	// Re-open the file for every read so nothing is reused from the write
+	f, err := os.Open(testFileLocation)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if n.config.DropCaches {
+		// Ask the kernel to drop the cached pages so the read goes to the server
+		if err := unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+			return err
+		}
+	}
+	got, err := ioutil.ReadAll(f)
+	n.countRead(len(got))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, b) {
+		return fmt.Errorf("read back %d bytes that don't match the %d bytes written", len(got), len(b))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// MIT License
+
+// Copyright (c) 2020 ddlfcloud
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// webhookPayload is the JSON body posted to the webhook.
+type webhookPayload struct {
+	Status              string `json:"status"`
+	Target              string `json:"target"`
+	Address             string `json:"address"`
+	MountPoint          string `json:"mount_point"`
+	Error               string `json:"error,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// updateAlert tracks consecutive failures and notifies the webhook when a target
+// starts or stops failing. Alerts only resolve after as many consecutive successes as
+// it took to fire, so a flapping target doesn't spam the webhook.
+func (n *nfs) updateAlert(ctx context.Context, result Result) {
+	if n.config.WebhookURL == "" || n.config.AlertAfter <= 0 {
+		return
+	}
+	err := result.Err()
+	n.mu.Lock()
+	var payload *webhookPayload
+	if err != nil && !n.alerting && n.consecutiveFailures >= n.config.AlertAfter {
+		n.alerting = true
+		payload = &webhookPayload{Status: "firing", Error: err.Error()}
+	}
+	if err == nil && n.alerting && n.consecutiveSuccesses >= n.config.AlertAfter {
+		n.alerting = false
+		payload = &webhookPayload{Status: "resolved"}
+	}
+	if payload != nil {
+		payload.ConsecutiveFailures = n.consecutiveFailures
+	}
+	n.mu.Unlock()
+	if payload == nil {
+		return
+	}
+	payload.Target = n.target.String()
+	payload.Address = n.address
+	payload.MountPoint = n.mountPoint
+	go n.postWebhook(ctx, *payload)
+}
+
+func (n *nfs) postWebhook(ctx context.Context, payload webhookPayload) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err}).Warn("could not encode webhook payload")
+		return
+	}
+	resp, err := webhookClient.Post(n.config.WebhookURL, "application/json", bytes.NewReader(b))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "err": err, "status": payload.Status}).Warn("could not notify webhook")
+		return
+	}
+	n.logger(ctx).WithFields(logrus.Fields{"address": n.address, "mountPoint": n.mountPoint, "status": payload.Status, "consecutiveFailures": payload.ConsecutiveFailures}).Info("notified webhook")
+}